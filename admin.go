@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//go:embed admin
+var adminFiles embed.FS
+
+// TopicCount is the number of subscriptions of a topic.
+type TopicCount struct {
+	Topic         string `json:"topic"`
+	Subscriptions int    `json:"subscriptions"`
+	Configured    bool   `json:"configured"`
+}
+
+// DeliveryStats counts the delivery attempts logged since a point in time.
+type DeliveryStats struct {
+	Since     string `json:"since"`
+	Attempts  int    `json:"attempts"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Stale     int    `json:"stale"`
+}
+
+// DeliveryFailure is a failed delivery attempt from the delivery log.
+type DeliveryFailure struct {
+	ID             int64  `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	NotificationID string `json:"notification_id,omitempty"`
+	Topic          string `json:"topic"`
+	StatusCode     int    `json:"status_code"`
+	Error          string `json:"error,omitempty"`
+	SentAt         string `json:"sent_at"`
+}
+
+// Stats is the JSON response for GET /stats.
+type Stats struct {
+	Subscriptions  int               `json:"subscriptions"`
+	Topics         []TopicCount      `json:"topics"`
+	Deliveries     DeliveryStats     `json:"deliveries"`
+	RecentFailures []DeliveryFailure `json:"recent_failures"`
+}
+
+// CountSubscriptionsByTopic returns the subscription count of every topic that
+// has subscriptions or a topic config, ordered by topic.
+func CountSubscriptionsByTopic(db *sql.DB) ([]TopicCount, error) {
+	rows, err := db.Query(`
+		SELECT topic, SUM(subs), MAX(configured) FROM (
+			SELECT topic, COUNT(*) AS subs, 0 AS configured FROM subscriptions GROUP BY topic
+			UNION ALL
+			SELECT name, 0, 1 FROM topics
+		) GROUP BY topic ORDER BY topic
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query topic counts: %w", err)
+	}
+	defer rows.Close()
+
+	var counts []TopicCount
+	for rows.Next() {
+		var c TopicCount
+		if err := rows.Scan(&c.Topic, &c.Subscriptions, &c.Configured); err != nil {
+			return nil, fmt.Errorf("scan topic count: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// GetDeliveryStats counts the delivery attempts logged since the given time.
+func GetDeliveryStats(db *sql.DB, since time.Time) (DeliveryStats, error) {
+	stats := DeliveryStats{Since: since.UTC().Format("2006-01-02 15:04:05")}
+	err := db.QueryRow(`
+		SELECT COUNT(*),
+			COALESCE(SUM(status_code BETWEEN 200 AND 299), 0),
+			COALESCE(SUM(status_code IN (404, 410)), 0)
+		FROM delivery_log WHERE sent_at >= ?
+	`, stats.Since).Scan(&stats.Attempts, &stats.Succeeded, &stats.Stale)
+	if err != nil {
+		return DeliveryStats{}, fmt.Errorf("query delivery stats: %w", err)
+	}
+	stats.Failed = stats.Attempts - stats.Succeeded
+	return stats, nil
+}
+
+// ListDeliveryFailures returns the most recent failed delivery attempts,
+// newest first. The topic comes from the subscription, or from the
+// notification if the subscription was since removed.
+func ListDeliveryFailures(db *sql.DB, limit int) ([]DeliveryFailure, error) {
+	rows, err := db.Query(`
+		SELECT d.id, d.subscription_id, d.notification_id, COALESCE(s.topic, n.topic, ''), d.status_code, d.error, d.sent_at
+		FROM delivery_log d
+		LEFT JOIN subscriptions s ON s.id = d.subscription_id
+		LEFT JOIN notifications n ON n.id = d.notification_id AND d.notification_id != ''
+		WHERE d.status_code NOT BETWEEN 200 AND 299
+		ORDER BY d.id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query delivery failures: %w", err)
+	}
+	defer rows.Close()
+
+	var failures []DeliveryFailure
+	for rows.Next() {
+		var f DeliveryFailure
+		if err := rows.Scan(&f.ID, &f.SubscriptionID, &f.NotificationID, &f.Topic, &f.StatusCode, &f.Error, &f.SentAt); err != nil {
+			return nil, fmt.Errorf("scan delivery failure: %w", err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// HandleStats returns subscription counts per topic, delivery stats over a
+// window (default 24h) and the 50 most recent delivery failures (admin).
+func (s *Server) HandleStats(w http.ResponseWriter, r *http.Request) {
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := parseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		window = d
+	}
+
+	var stats Stats
+	var err error
+	if stats.Topics, err = CountSubscriptionsByTopic(s.DB); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to count subscriptions")
+		return
+	}
+	if stats.Deliveries, err = GetDeliveryStats(s.DB, time.Now().Add(-window)); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get delivery stats")
+		return
+	}
+	if stats.RecentFailures, err = ListDeliveryFailures(s.DB, 50); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list delivery failures")
+		return
+	}
+
+	for _, t := range stats.Topics {
+		stats.Subscriptions += t.Subscriptions
+	}
+	if stats.Topics == nil {
+		stats.Topics = []TopicCount{}
+	}
+	if stats.RecentFailures == nil {
+		stats.RecentFailures = []DeliveryFailure{}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// adminHandler serves the embedded admin dashboard under /admin/. The page
+// itself is public; it asks for the admin key and sends it with every API
+// request it makes.
+func adminHandler() http.Handler {
+	sub, err := fs.Sub(adminFiles, "admin")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/admin/", http.FileServerFS(sub))
+}
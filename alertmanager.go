@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// alertmanagerWebhook is the body of an Alertmanager webhook notification:
+// the alerts of one group.
+type alertmanagerWebhook struct {
+	Version           string              `json:"version"`
+	GroupKey          string              `json:"groupKey"`
+	Status            string              `json:"status"`
+	Receiver          string              `json:"receiver"`
+	GroupLabels       map[string]string   `json:"groupLabels"`
+	CommonLabels      map[string]string   `json:"commonLabels"`
+	CommonAnnotations map[string]string   `json:"commonAnnotations"`
+	ExternalURL       string              `json:"externalURL"`
+	Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// severityUrgencies maps alert severity labels to push urgencies. Unknown
+// severities are sent with normal urgency.
+var severityUrgencies = map[string]webpush.Urgency{
+	"critical": webpush.UrgencyHigh,
+	"page":     webpush.UrgencyHigh,
+	"error":    webpush.UrgencyHigh,
+	"warning":  webpush.UrgencyNormal,
+	"info":     webpush.UrgencyLow,
+	"none":     webpush.UrgencyVeryLow,
+}
+
+var urgencyRanks = map[webpush.Urgency]int{
+	webpush.UrgencyVeryLow: 0,
+	webpush.UrgencyLow:     1,
+	webpush.UrgencyNormal:  2,
+	webpush.UrgencyHigh:    3,
+}
+
+// alertmanagerTag returns the notification tag of an alert group, so that
+// each notification for the group replaces the previous one.
+func alertmanagerTag(groupKey string) string {
+	sum := sha256.Sum256([]byte(groupKey))
+	return "alertmanager:" + hex.EncodeToString(sum[:8])
+}
+
+// alertSummary returns the line describing an alert in the notification body.
+func alertSummary(a alertmanagerAlert) string {
+	summary := a.Annotations["summary"]
+	if summary == "" {
+		summary = a.Annotations["description"]
+	}
+	if summary == "" {
+		summary = a.Labels["alertname"]
+	}
+	if instance := a.Labels["instance"]; instance != "" && !strings.Contains(summary, instance) {
+		summary += " (" + instance + ")"
+	}
+	return summary
+}
+
+// alertmanagerRequest maps an alert group onto a single notification. The
+// title gives the group's status and labels, like Alertmanager's default
+// templates; the body lists the alerts, firing ones first. Firing groups take
+// the urgency of their most severe firing alert and alert again on every
+// update. Resolved groups silently replace the firing notification.
+func alertmanagerRequest(topic string, wh alertmanagerWebhook) NotifyRequest {
+	var firing, resolved []alertmanagerAlert
+	for _, a := range wh.Alerts {
+		if a.Status == "resolved" {
+			resolved = append(resolved, a)
+		} else {
+			firing = append(firing, a)
+		}
+	}
+
+	labels := make([]string, 0, len(wh.GroupLabels))
+	for name := range wh.GroupLabels {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	values := make([]string, len(labels))
+	for i, name := range labels {
+		values[i] = wh.GroupLabels[name]
+	}
+	name := strings.Join(values, " ")
+	if name == "" {
+		name = wh.CommonLabels["alertname"]
+	}
+	if name == "" {
+		name = "alerts"
+	}
+
+	req := NotifyRequest{
+		Topic:    topic,
+		Tag:      alertmanagerTag(wh.GroupKey),
+		Truncate: true,
+		Data:     map[string]any{"status": wh.Status, "group_key": wh.GroupKey},
+	}
+
+	var lines []string
+	if wh.Status == "resolved" {
+		req.Title = "[RESOLVED] " + name
+		req.Urgency = string(webpush.UrgencyNormal)
+		silent := true
+		req.Silent = &silent
+	} else {
+		req.Title = fmt.Sprintf("[FIRING:%d] %s", len(firing), name)
+		req.Renotify = true
+		urgency := webpush.UrgencyVeryLow
+		for _, a := range firing {
+			u, ok := severityUrgencies[strings.ToLower(a.Labels["severity"])]
+			if !ok {
+				u = webpush.UrgencyNormal
+			}
+			if urgencyRanks[u] > urgencyRanks[urgency] {
+				urgency = u
+			}
+			lines = append(lines, "🔥 "+alertSummary(a))
+		}
+		req.Urgency = string(urgency)
+	}
+	for _, a := range resolved {
+		lines = append(lines, "✅ "+alertSummary(a))
+	}
+	req.Body = strings.Join(lines, "\n")
+
+	// Link to the alert's source, or to Alertmanager.
+	link := wh.ExternalURL
+	if len(wh.Alerts) > 0 && wh.Alerts[0].GeneratorURL != "" {
+		link = wh.Alerts[0].GeneratorURL
+	}
+	if link != "" {
+		req.Data["url"] = link
+		if isHTTPSURL(link) {
+			req.Navigate = link
+		}
+	}
+	return req
+}
+
+// HandleAlertmanager receives an Alertmanager webhook and sends one
+// notification for its alert group to the topic's subscribers (public, like
+// topic notify).
+func (s *Server) HandleAlertmanager(w http.ResponseWriter, r *http.Request) {
+	var wh alertmanagerWebhook
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if wh.GroupKey == "" || len(wh.Alerts) == 0 {
+		writeError(w, http.StatusBadRequest, "groupKey and alerts are required")
+		return
+	}
+
+	req := alertmanagerRequest(r.PathValue("topic"), wh)
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+
+	result := s.SendNotifications(req)
+	result.Truncated = truncated
+	if !s.verbose(r) {
+		result.Deliveries = nil
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -4,9 +4,11 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -22,7 +24,9 @@ func OpenDB(path string) (*sql.DB, error) {
 		}
 	}
 
-	dsn := path + "?_journal_mode=WAL&_busy_timeout=5000"
+	// modernc.org/sqlite takes pragmas as _pragma parameters; without the
+	// busy timeout, concurrent writes fail with SQLITE_BUSY.
+	dsn := path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
@@ -56,12 +60,146 @@ func migrate(db *sql.DB) error {
 			error           TEXT NOT NULL DEFAULT ''
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_delivery_log_sent_at ON delivery_log(sent_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_delivery_log_subscription ON delivery_log(subscription_id, sent_at)`,
+		`CREATE TABLE IF NOT EXISTS topics (
+			name          TEXT PRIMARY KEY,
+			frequency_cap TEXT NOT NULL DEFAULT '',
+			created_at    TEXT NOT NULL DEFAULT (datetime('now')),
+			updated_at    TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS deferred_notifications (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			subscription_id TEXT NOT NULL,
+			request         TEXT NOT NULL,
+			deliver_at      TEXT NOT NULL,
+			created_at      TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_deferred_notifications_deliver_at ON deferred_notifications(deliver_at)`,
+		`CREATE TABLE IF NOT EXISTS digest_events (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic      TEXT NOT NULL,
+			request    TEXT NOT NULL,
+			created_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_digest_events_topic ON digest_events(topic, created_at)`,
+		`CREATE TABLE IF NOT EXISTS templates (
+			name       TEXT PRIMARY KEY,
+			title      TEXT NOT NULL,
+			body       TEXT NOT NULL DEFAULT '',
+			icon       TEXT NOT NULL DEFAULT '',
+			data       TEXT NOT NULL DEFAULT '{}',
+			created_at TEXT NOT NULL DEFAULT (datetime('now')),
+			updated_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS hooks (
+			name       TEXT PRIMARY KEY,
+			secret     TEXT NOT NULL,
+			mapping    TEXT NOT NULL,
+			created_at TEXT NOT NULL DEFAULT (datetime('now')),
+			updated_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			scope        TEXT NOT NULL,
+			key          TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			status       INTEGER NOT NULL DEFAULT 0,
+			response     TEXT NOT NULL DEFAULT '',
+			created_at   TEXT NOT NULL DEFAULT (datetime('now')),
+			PRIMARY KEY (scope, key)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at)`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id         TEXT PRIMARY KEY,
+			url        TEXT NOT NULL,
+			events     TEXT NOT NULL,
+			secret     TEXT NOT NULL,
+			created_at TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id  TEXT NOT NULL,
+			event_id    TEXT NOT NULL,
+			event       TEXT NOT NULL,
+			attempt     INTEGER NOT NULL,
+			status_code INTEGER NOT NULL,
+			error       TEXT NOT NULL DEFAULT '',
+			created_at  TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id)`,
+		`CREATE TABLE IF NOT EXISTS gotify_apps (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			token       TEXT NOT NULL UNIQUE,
+			name        TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			topic       TEXT NOT NULL DEFAULT '',
+			created_at  TEXT NOT NULL DEFAULT (datetime('now'))
+		)`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id           TEXT PRIMARY KEY,
+			topic        TEXT NOT NULL DEFAULT '',
+			request      TEXT NOT NULL,
+			created_at   TEXT NOT NULL DEFAULT (datetime('now')),
+			updated_at   TEXT NOT NULL DEFAULT (datetime('now')),
+			retracted_at TEXT NOT NULL DEFAULT ''
+		)`,
 	}
 	for _, s := range statements {
 		if _, err := db.Exec(s); err != nil {
 			return fmt.Errorf("exec %q: %w", s[:40], err)
 		}
 	}
+
+	// Columns added after the initial schema.
+	columns := []struct{ table, column, def string }{
+		{"subscriptions", "locale", `TEXT NOT NULL DEFAULT ''`},
+		{"subscriptions", "timezone", `TEXT NOT NULL DEFAULT ''`},
+		{"subscriptions", "quiet_start", `TEXT NOT NULL DEFAULT ''`},
+		{"subscriptions", "quiet_end", `TEXT NOT NULL DEFAULT ''`},
+		{"subscriptions", "quiet_mode", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "batch_window", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "batch_template", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "title", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "description", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "icon", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "page", `INTEGER NOT NULL DEFAULT 0`},
+		{"topics", "github_secret", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "gitlab_token", `TEXT NOT NULL DEFAULT ''`},
+		{"topics", "repo_events", `TEXT NOT NULL DEFAULT ''`},
+		{"delivery_log", "notification_id", `TEXT NOT NULL DEFAULT ''`},
+		{"deferred_notifications", "notification_id", `TEXT NOT NULL DEFAULT ''`},
+		{"digest_events", "notification_id", `TEXT NOT NULL DEFAULT ''`},
+	}
+	for _, c := range columns {
+		if err := addColumn(db, c.table, c.column, c.def); err != nil {
+			return err
+		}
+	}
+
+	// Indexes on added columns.
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_delivery_log_notification ON delivery_log(notification_id)`,
+	}
+	for _, s := range indexes {
+		if _, err := db.Exec(s); err != nil {
+			return fmt.Errorf("exec %q: %w", s[:40], err)
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table unless it is already present
+// (SQLite has no ADD COLUMN IF NOT EXISTS).
+func addColumn(db *sql.DB, table, column, def string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+		return fmt.Errorf("inspect %s.%s: %w", table, column, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def)); err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -73,12 +211,17 @@ func randomID() string {
 
 // Subscription represents a stored push subscription.
 type Subscription struct {
-	ID        string `json:"id"`
-	Topic     string `json:"topic"`
-	Endpoint  string `json:"endpoint"`
-	KeyP256dh string `json:"key_p256dh,omitempty"`
-	KeyAuth   string `json:"key_auth,omitempty"`
-	CreatedAt string `json:"created_at"`
+	ID         string `json:"id"`
+	Topic      string `json:"topic"`
+	Endpoint   string `json:"endpoint"`
+	KeyP256dh  string `json:"key_p256dh,omitempty"`
+	KeyAuth    string `json:"key_auth,omitempty"`
+	Locale     string `json:"locale,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	QuietMode  string `json:"quiet_mode,omitempty"`
+	CreatedAt  string `json:"created_at"`
 }
 
 // UpsertSubscription inserts or updates a subscription by endpoint.
@@ -110,15 +253,35 @@ func UpsertSubscription(db *sql.DB, topic, endpoint, p256dh, auth string) (id st
 	return actualID, created, nil
 }
 
+// SetSubscriptionLocale records the preferred locale of a browser on all of
+// its subscriptions (every topic of the endpoint).
+func SetSubscriptionLocale(db *sql.DB, endpoint, locale string) error {
+	_, err := db.Exec(`UPDATE subscriptions SET locale = ? WHERE endpoint = ?`, locale, endpoint)
+	return err
+}
+
+// subscriptionColumns lists the columns scanned by scanSubscription.
+const subscriptionColumns = `id, topic, endpoint, key_p256dh, key_auth, locale, timezone, quiet_start, quiet_end, quiet_mode, created_at`
+
+func scanSubscription(rows interface{ Scan(...any) error }) (Subscription, error) {
+	var s Subscription
+	err := rows.Scan(&s.ID, &s.Topic, &s.Endpoint, &s.KeyP256dh, &s.KeyAuth, &s.Locale,
+		&s.Timezone, &s.QuietStart, &s.QuietEnd, &s.QuietMode, &s.CreatedAt)
+	if err != nil {
+		return Subscription{}, fmt.Errorf("scan subscription: %w", err)
+	}
+	return s, nil
+}
+
 // GetSubscriptionsByTopic returns subscriptions matching the given topic.
 // If topic is empty, returns all subscriptions.
 func GetSubscriptionsByTopic(db *sql.DB, topic string) ([]Subscription, error) {
 	var rows *sql.Rows
 	var err error
 	if topic == "" {
-		rows, err = db.Query(`SELECT id, topic, endpoint, key_p256dh, key_auth, created_at FROM subscriptions`)
+		rows, err = db.Query(`SELECT ` + subscriptionColumns + ` FROM subscriptions`)
 	} else {
-		rows, err = db.Query(`SELECT id, topic, endpoint, key_p256dh, key_auth, created_at FROM subscriptions WHERE topic = ?`, topic)
+		rows, err = db.Query(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE topic = ?`, topic)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query subscriptions: %w", err)
@@ -127,36 +290,169 @@ func GetSubscriptionsByTopic(db *sql.DB, topic string) ([]Subscription, error) {
 
 	var subs []Subscription
 	for rows.Next() {
-		var s Subscription
-		if err := rows.Scan(&s.ID, &s.Topic, &s.Endpoint, &s.KeyP256dh, &s.KeyAuth, &s.CreatedAt); err != nil {
-			return nil, fmt.Errorf("scan subscription: %w", err)
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
 		}
 		subs = append(subs, s)
 	}
 	return subs, rows.Err()
 }
 
+// GetSubscriptionsByIDs returns the subscriptions with the given IDs, and
+// the IDs that matched no subscription (in request order).
+func GetSubscriptionsByIDs(db *sql.DB, ids []string) ([]Subscription, []string, error) {
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat("?, ", len(ids)-1) + "?"
+	rows, err := db.Query(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	found := make(map[string]bool)
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		subs = append(subs, s)
+		found[s.ID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var unknown []string
+	for _, id := range ids {
+		if !found[id] {
+			unknown = append(unknown, id)
+			found[id] = true // report duplicates once
+		}
+	}
+	return subs, unknown, nil
+}
+
 // DeleteSubscriptionByEndpoint removes subscriptions by endpoint URL.
 // If topic is non-empty, only the subscription for that specific topic is removed.
-func DeleteSubscriptionByEndpoint(db *sql.DB, endpoint, topic string) error {
+// Returns the removed subscriptions.
+func DeleteSubscriptionByEndpoint(db *sql.DB, endpoint, topic string) ([]Subscription, error) {
 	if topic != "" {
-		_, err := db.Exec(`DELETE FROM subscriptions WHERE endpoint = ? AND topic = ?`, endpoint, topic)
-		return err
+		return deleteSubscriptions(db, `DELETE FROM subscriptions WHERE endpoint = ? AND topic = ? RETURNING `+subscriptionColumns, endpoint, topic)
 	}
-	_, err := db.Exec(`DELETE FROM subscriptions WHERE endpoint = ?`, endpoint)
-	return err
+	return deleteSubscriptions(db, `DELETE FROM subscriptions WHERE endpoint = ? RETURNING `+subscriptionColumns, endpoint)
 }
 
-// DeleteSubscriptionByID removes a subscription by its ID.
-func DeleteSubscriptionByID(db *sql.DB, id string) error {
-	_, err := db.Exec(`DELETE FROM subscriptions WHERE id = ?`, id)
-	return err
+// deleteSubscriptions runs a DELETE ... RETURNING subscriptionColumns query.
+func deleteSubscriptions(db *sql.DB, query string, args ...any) ([]Subscription, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("delete subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// RotateSubscription moves every subscription registered for oldEndpoint to
+// newEndpoint with the new keys, keeping IDs and topics. Topics the new
+// endpoint is already subscribed to keep the existing row, which takes the
+// old row's preferences where it has none and its deferred notifications,
+// and drop the old one. Rotating to the same endpoint only updates the keys.
+// Returns the number of topics migrated (0 if oldEndpoint is unknown).
+func RotateSubscription(db *sql.DB, oldEndpoint, newEndpoint, p256dh, auth string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin rotate: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, topic FROM subscriptions WHERE endpoint = ?`, oldEndpoint)
+	if err != nil {
+		return 0, fmt.Errorf("query old subscriptions: %w", err)
+	}
+	type row struct{ id, topic string }
+	var old []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.topic); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan subscription: %w", err)
+		}
+		old = append(old, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range old {
+		var existingID string
+		err := tx.QueryRow(`SELECT id FROM subscriptions WHERE endpoint = ? AND topic = ? AND id != ?`, newEndpoint, r.topic, r.id).Scan(&existingID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("check new subscription: %w", err)
+		}
+		if existingID != "" {
+			if _, err := tx.Exec(`
+				UPDATE subscriptions SET
+					key_p256dh = ?,
+					key_auth = ?,
+					locale = CASE WHEN subscriptions.locale = '' THEN old.locale ELSE subscriptions.locale END,
+					timezone = CASE WHEN subscriptions.timezone = '' THEN old.timezone ELSE subscriptions.timezone END,
+					quiet_start = CASE WHEN subscriptions.quiet_start = '' THEN old.quiet_start ELSE subscriptions.quiet_start END,
+					quiet_end = CASE WHEN subscriptions.quiet_end = '' THEN old.quiet_end ELSE subscriptions.quiet_end END,
+					quiet_mode = CASE WHEN subscriptions.quiet_mode = '' THEN old.quiet_mode ELSE subscriptions.quiet_mode END
+				FROM (SELECT locale, timezone, quiet_start, quiet_end, quiet_mode FROM subscriptions WHERE id = ?) AS old
+				WHERE subscriptions.id = ?
+			`, p256dh, auth, r.id, existingID); err != nil {
+				return 0, fmt.Errorf("update new subscription: %w", err)
+			}
+			if _, err := tx.Exec(`UPDATE deferred_notifications SET subscription_id = ? WHERE subscription_id = ?`, existingID, r.id); err != nil {
+				return 0, fmt.Errorf("move deferred notifications: %w", err)
+			}
+			if _, err := tx.Exec(`DELETE FROM subscriptions WHERE id = ?`, r.id); err != nil {
+				return 0, fmt.Errorf("delete old subscription: %w", err)
+			}
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE subscriptions SET endpoint = ?, key_p256dh = ?, key_auth = ? WHERE id = ?`,
+			newEndpoint, p256dh, auth, r.id); err != nil {
+			return 0, fmt.Errorf("migrate subscription: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit rotate: %w", err)
+	}
+	return len(old), nil
+}
+
+// DeleteSubscriptionByID removes a subscription by its ID. Returns the
+// removed subscription, if any.
+func DeleteSubscriptionByID(db *sql.DB, id string) ([]Subscription, error) {
+	return deleteSubscriptions(db, `DELETE FROM subscriptions WHERE id = ? RETURNING `+subscriptionColumns, id)
 }
 
 // LogDelivery records a delivery attempt in the delivery_log table.
-func LogDelivery(db *sql.DB, subscriptionID string, statusCode int, errMsg string) error {
-	_, err := db.Exec(`INSERT INTO delivery_log (subscription_id, status_code, error) VALUES (?, ?, ?)`,
-		subscriptionID, statusCode, errMsg)
+// notificationID is empty for untracked sends (e.g. the welcome message).
+func LogDelivery(db *sql.DB, subscriptionID, notificationID string, statusCode int, errMsg string) error {
+	_, err := db.Exec(`INSERT INTO delivery_log (subscription_id, notification_id, status_code, error) VALUES (?, ?, ?, ?)`,
+		subscriptionID, notificationID, statusCode, errMsg)
 	return err
 }
 
@@ -176,9 +472,9 @@ func ListSubscriptionsAdmin(db *sql.DB, topic string) ([]Subscription, error) {
 	var rows *sql.Rows
 	var err error
 	if topic == "" {
-		rows, err = db.Query(`SELECT id, topic, endpoint, created_at FROM subscriptions`)
+		rows, err = db.Query(`SELECT id, topic, endpoint, locale, timezone, quiet_start, quiet_end, quiet_mode, created_at FROM subscriptions`)
 	} else {
-		rows, err = db.Query(`SELECT id, topic, endpoint, created_at FROM subscriptions WHERE topic = ?`, topic)
+		rows, err = db.Query(`SELECT id, topic, endpoint, locale, timezone, quiet_start, quiet_end, quiet_mode, created_at FROM subscriptions WHERE topic = ?`, topic)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("query subscriptions: %w", err)
@@ -188,7 +484,7 @@ func ListSubscriptionsAdmin(db *sql.DB, topic string) ([]Subscription, error) {
 	var subs []Subscription
 	for rows.Next() {
 		var s Subscription
-		if err := rows.Scan(&s.ID, &s.Topic, &s.Endpoint, &s.CreatedAt); err != nil {
+		if err := rows.Scan(&s.ID, &s.Topic, &s.Endpoint, &s.Locale, &s.Timezone, &s.QuietStart, &s.QuietEnd, &s.QuietMode, &s.CreatedAt); err != nil {
 			return nil, fmt.Errorf("scan subscription: %w", err)
 		}
 		subs = append(subs, s)
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// digestEvent is a notification held back by a topic's batching policy.
+type digestEvent struct {
+	CreatedAt string
+	Request   NotifyRequest
+}
+
+// AddDigestEvent records a notification to be included in the topic's next digest.
+func AddDigestEvent(db *sql.DB, topic string, req NotifyRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal digest event: %w", err)
+	}
+	_, err = db.Exec(`INSERT INTO digest_events (topic, notification_id, request) VALUES (?, ?, ?)`, topic, req.ID, string(data))
+	return err
+}
+
+// PendingDigests returns, for each topic with batched events, the time its
+// oldest event was recorded.
+func PendingDigests(db *sql.DB) (map[string]time.Time, error) {
+	rows, err := db.Query(`SELECT topic, MIN(created_at) FROM digest_events GROUP BY topic`)
+	if err != nil {
+		return nil, fmt.Errorf("query digest events: %w", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[string]time.Time)
+	for rows.Next() {
+		var topic, oldest string
+		if err := rows.Scan(&topic, &oldest); err != nil {
+			return nil, fmt.Errorf("scan digest events: %w", err)
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", oldest, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("parse digest event time: %w", err)
+		}
+		pending[topic] = t
+	}
+	return pending, rows.Err()
+}
+
+// TakeDigestEvents removes and returns the batched events of a topic, oldest first.
+func TakeDigestEvents(db *sql.DB, topic string) ([]digestEvent, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin take digest: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, notification_id, request, created_at FROM digest_events WHERE topic = ? ORDER BY id`, topic)
+	if err != nil {
+		return nil, fmt.Errorf("query digest events: %w", err)
+	}
+	var events []digestEvent
+	var lastID int64
+	for rows.Next() {
+		var e digestEvent
+		var request, notificationID string
+		if err := rows.Scan(&lastID, &notificationID, &request, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan digest event: %w", err)
+		}
+		if err := json.Unmarshal([]byte(request), &e.Request); err != nil {
+			log.Printf("discarding undecodable digest event for topic %q: %v", topic, err)
+			continue
+		}
+		e.Request.ID = notificationID
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM digest_events WHERE topic = ? AND id <= ?`, topic, lastID); err != nil {
+		return nil, fmt.Errorf("delete digest events: %w", err)
+	}
+	return events, tx.Commit()
+}
+
+// topicBatches reports whether a topic has a batching policy.
+func (s *Server) topicBatches(topic string) (bool, error) {
+	t, err := GetTopicConfig(s.DB, topic)
+	if errors.Is(err, errTopicNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.BatchWindow != "", nil
+}
+
+// batchNotification holds req back for the topic's next digest if the
+// topic has a batching policy. Returns whether the notification was batched.
+func (s *Server) batchNotification(req NotifyRequest) (bool, error) {
+	batches, err := s.topicBatches(req.Topic)
+	if err != nil || !batches {
+		return false, err
+	}
+	if err := AddDigestEvent(s.DB, req.Topic, req); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// digestRequest builds the summary notification for events (oldest first).
+// A single event is sent unchanged. Otherwise the summary is rendered from
+// tmpl if set, or lists the event titles, and takes its click target and
+// data from the most recent event.
+func digestRequest(topic string, events []NotifyRequest, tmpl *Template) (NotifyRequest, error) {
+	if len(events) == 1 {
+		return events[0], nil
+	}
+
+	last := events[len(events)-1]
+	req := NotifyRequest{
+		Topic:    topic,
+		Navigate: last.Navigate,
+		Icon:     last.Icon,
+		Badge:    last.Badge,
+		Tag:      "digest:" + topic,
+		Data:     last.Data,
+		Urgency:  last.Urgency,
+		Truncate: true,
+	}
+
+	if tmpl != nil {
+		items := make([]map[string]any, len(events))
+		for i, e := range events {
+			items[i] = map[string]any{"title": e.Title, "body": e.Body, "data": e.Data}
+		}
+		rendered, err := tmpl.Render(map[string]any{
+			"topic":  topic,
+			"count":  len(events),
+			"events": items,
+			"last":   items[len(items)-1],
+		})
+		if err != nil {
+			return NotifyRequest{}, err
+		}
+		req.Title = rendered.Title
+		req.Body = rendered.Body
+		if rendered.Icon != "" {
+			req.Icon = rendered.Icon
+		}
+		if len(rendered.Data) > 0 {
+			req.Data = rendered.Data
+		}
+	} else {
+		titles := make([]string, len(events))
+		for i, e := range events {
+			titles[len(events)-1-i] = e.Title // newest first
+		}
+		req.Title = fmt.Sprintf("%d new notifications", len(events))
+		req.Body = strings.Join(titles, "\n")
+	}
+
+	if _, err := fitPayload(&req); err != nil {
+		return NotifyRequest{}, err
+	}
+	return req, nil
+}
+
+// flushDigestsLoop sends the digests of topics whose batch window has
+// elapsed since their oldest pending event, checking every 30 seconds.
+func (s *Server) flushDigestsLoop(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flushDigests(time.Now())
+		}
+	}
+}
+
+func (s *Server) flushDigests(now time.Time) {
+	s.WG.Add(1)
+	defer s.WG.Done()
+
+	pending, err := PendingDigests(s.DB)
+	if err != nil {
+		log.Printf("digest flush error: %v", err)
+		return
+	}
+	for topic, oldest := range pending {
+		// Events of a topic whose batching was since disabled are flushed right away.
+		var window time.Duration
+		t, err := GetTopicConfig(s.DB, topic)
+		if err != nil && !errors.Is(err, errTopicNotFound) {
+			log.Printf("digest flush error for topic %q: %v", topic, err)
+			continue
+		}
+		if t.BatchWindow != "" {
+			window, _ = parseDuration(t.BatchWindow)
+		}
+		if now.Sub(oldest) < window {
+			continue
+		}
+		s.flushDigest(topic, t.BatchTemplate)
+	}
+}
+
+// flushDigest sends one summary per subscriber covering the topic's batched
+// events recorded since that subscriber joined.
+func (s *Server) flushDigest(topic, templateName string) {
+	events, err := TakeDigestEvents(s.DB, topic)
+	if err != nil || len(events) == 0 {
+		if err != nil {
+			log.Printf("digest flush error for topic %q: %v", topic, err)
+		}
+		return
+	}
+
+	var tmpl *Template
+	if templateName != "" {
+		t, err := GetTemplate(s.DB, templateName)
+		if err != nil {
+			log.Printf("digest template %q for topic %q: %v (using default summary)", templateName, topic, err)
+		} else {
+			tmpl = &t
+		}
+	}
+
+	subs, err := GetSubscriptionsByTopic(s.DB, topic)
+	if err != nil {
+		log.Printf("error fetching subscriptions: %v", err)
+		return
+	}
+
+	// Group subscribers by the first event they should see.
+	groups := make(map[int][]Subscription)
+	for _, sub := range subs {
+		i := sort.Search(len(events), func(i int) bool { return events[i].CreatedAt >= sub.CreatedAt })
+		if i < len(events) {
+			groups[i] = append(groups[i], sub)
+		}
+	}
+
+	requests := make([]NotifyRequest, len(events))
+	for i, e := range events {
+		requests[i] = e.Request
+	}
+	for first, group := range groups {
+		req, err := digestRequest(topic, requests[first:], tmpl)
+		if err != nil {
+			log.Printf("error building digest for topic %q: %v", topic, err)
+			continue
+		}
+		s.sendToSubscriptions(group, req)
+	}
+}
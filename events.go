@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventDeliveryAttempted is published for every push delivery attempt. It is
+// only streamed on GET /events, not posted to webhooks.
+const eventDeliveryAttempted = "delivery.attempted"
+
+// eventBufferSize is the number of recent events kept for Last-Event-ID resume.
+const eventBufferSize = 1000
+
+// streamedEvent is an event as kept by the event bus, numbered in publish
+// order. The number is its SSE event ID.
+type streamedEvent struct {
+	Seq   uint64
+	Topic string
+	Event
+}
+
+// eventBus fans server events out to the connected GET /events streams and
+// keeps the most recent ones in a ring buffer. The zero value is ready to use.
+type eventBus struct {
+	mu     sync.Mutex
+	seq    uint64
+	ring   [eventBufferSize]streamedEvent
+	subs   map[chan streamedEvent]struct{}
+	closed bool
+}
+
+// publish numbers ev and sends it to every stream. A stream that is not
+// keeping up is closed; its client resumes from the buffer on reconnect.
+func (b *eventBus) publish(topic string, ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	se := streamedEvent{Seq: b.seq, Topic: topic, Event: ev}
+	b.ring[b.seq%eventBufferSize] = se
+	for ch := range b.subs {
+		select {
+		case ch <- se:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a new stream. If resume is set, it also returns the
+// buffered events published after lastSeq, oldest first; a lastSeq ahead of
+// the bus (the server restarted) replays the whole buffer. Returns false once
+// the bus is closed.
+func (b *eventBus) subscribe(lastSeq uint64, resume bool) ([]streamedEvent, chan streamedEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil, false
+	}
+
+	var backlog []streamedEvent
+	if resume && lastSeq != b.seq {
+		first := uint64(1)
+		if b.seq > eventBufferSize {
+			first = b.seq - eventBufferSize + 1
+		}
+		if lastSeq < b.seq && lastSeq >= first {
+			first = lastSeq + 1
+		}
+		for seq := first; seq <= b.seq; seq++ {
+			backlog = append(backlog, b.ring[seq%eventBufferSize])
+		}
+	}
+
+	ch := make(chan streamedEvent, 256)
+	if b.subs == nil {
+		b.subs = make(map[chan streamedEvent]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	return backlog, ch, true
+}
+
+// unsubscribe removes a stream registered with subscribe.
+func (b *eventBus) unsubscribe(ch chan streamedEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends all streams and refuses new ones, so that they do not hold up
+// the HTTP server's graceful shutdown.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// CloseEventStreams ends the GET /events streams. It is registered to run
+// when the HTTP server shuts down.
+func (s *Server) CloseEventStreams() {
+	s.events.close()
+}
+
+// newEvent builds an event of the given type.
+func newEvent(typ string, data any) Event {
+	return Event{
+		ID:        randomID(),
+		Type:      typ,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	}
+}
+
+// eventTopic returns the topic an event's data relates to.
+func eventTopic(data any) string {
+	switch d := data.(type) {
+	case SubscriptionEvent:
+		return d.Topic
+	case DeliveryEvent:
+		return d.Topic
+	case NotificationCompletedEvent:
+		return d.Topic
+	}
+	return ""
+}
+
+// streamEvent publishes an event to the GET /events streams only.
+func (s *Server) streamEvent(typ string, data any) Event {
+	ev := newEvent(typ, data)
+	s.events.publish(eventTopic(data), ev)
+	return ev
+}
+
+// HandleEvents streams server events as Server-Sent Events (admin). The topic
+// query parameter, repeatable, restricts the stream to those topics. A client
+// reconnecting with Last-Event-ID (or last_event_id) first receives the
+// buffered events it missed.
+func (s *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	topics := r.URL.Query()["topic"]
+
+	var lastSeq uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if lastID != "" {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+	}
+
+	backlog, ch, ok := s.events.subscribe(lastSeq, lastID != "")
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	defer s.events.unsubscribe(ch)
+
+	// The stream outlives any server write timeout.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+
+	write := func(se streamedEvent) error {
+		if len(topics) > 0 && !slices.Contains(topics, se.Topic) {
+			return nil
+		}
+		data, err := json.Marshal(se.Event)
+		if err != nil {
+			log.Printf("error encoding %s event: %v", se.Type, err)
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.Seq, se.Type, data)
+		return err
+	}
+
+	for _, se := range backlog {
+		if write(se) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case se, ok := <-ch:
+			if !ok {
+				return
+			}
+			if write(se) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
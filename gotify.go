@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// GotifyApp is a Gotify application: a token that publishes to a topic
+// through POST /message.
+type GotifyApp struct {
+	ID          int64  `json:"id"`
+	Token       string `json:"token"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Topic       string `json:"topic"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// gotifyMessage is a message in Gotify's format: the body of POST /message
+// and its response.
+type gotifyMessage struct {
+	ID       int64          `json:"id,omitempty"`
+	AppID    int64          `json:"appid,omitempty"`
+	Title    string         `json:"title,omitempty"`
+	Message  string         `json:"message"`
+	Priority *int           `json:"priority,omitempty"`
+	Extras   map[string]any `json:"extras,omitempty"`
+	Date     string         `json:"date,omitempty"`
+}
+
+var errGotifyAppNotFound = errors.New("gotify app not found")
+
+const gotifyAppColumns = `id, token, name, description, topic, created_at`
+
+func scanGotifyApp(row interface{ Scan(...any) error }) (GotifyApp, error) {
+	var a GotifyApp
+	err := row.Scan(&a.ID, &a.Token, &a.Name, &a.Description, &a.Topic, &a.CreatedAt)
+	return a, err
+}
+
+// CreateGotifyApp stores a new app with a generated token.
+func CreateGotifyApp(db *sql.DB, app GotifyApp) (GotifyApp, error) {
+	app.Token = "A" + randomID()
+	result, err := db.Exec(`INSERT INTO gotify_apps (token, name, description, topic) VALUES (?, ?, ?, ?)`,
+		app.Token, app.Name, app.Description, app.Topic)
+	if err != nil {
+		return GotifyApp{}, fmt.Errorf("insert gotify app: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return GotifyApp{}, err
+	}
+	return scanGotifyApp(db.QueryRow(`SELECT `+gotifyAppColumns+` FROM gotify_apps WHERE id = ?`, id))
+}
+
+// GetGotifyAppByToken returns the app of a token, or errGotifyAppNotFound.
+func GetGotifyAppByToken(db *sql.DB, token string) (GotifyApp, error) {
+	app, err := scanGotifyApp(db.QueryRow(`SELECT `+gotifyAppColumns+` FROM gotify_apps WHERE token = ?`, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return GotifyApp{}, errGotifyAppNotFound
+	}
+	if err != nil {
+		return GotifyApp{}, fmt.Errorf("query gotify app: %w", err)
+	}
+	return app, nil
+}
+
+// ListGotifyApps returns all apps, oldest first.
+func ListGotifyApps(db *sql.DB) ([]GotifyApp, error) {
+	rows, err := db.Query(`SELECT ` + gotifyAppColumns + ` FROM gotify_apps ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("query gotify apps: %w", err)
+	}
+	defer rows.Close()
+
+	var apps []GotifyApp
+	for rows.Next() {
+		a, err := scanGotifyApp(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan gotify app: %w", err)
+		}
+		apps = append(apps, a)
+	}
+	return apps, rows.Err()
+}
+
+// DeleteGotifyApp removes an app, revoking its token.
+func DeleteGotifyApp(db *sql.DB, id int64) error {
+	_, err := db.Exec(`DELETE FROM gotify_apps WHERE id = ?`, id)
+	return err
+}
+
+// gotifyToken returns the app token of a request, given like Gotify accepts
+// it: the token query parameter, the X-Gotify-Key header or a bearer token.
+func gotifyToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if token := r.Header.Get("X-Gotify-Key"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// decodeGotifyMessage reads a message sent as JSON or as a (multipart) form.
+func decodeGotifyMessage(r *http.Request) (gotifyMessage, error) {
+	var m gotifyMessage
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			return gotifyMessage{}, errors.New("invalid JSON")
+		}
+		return m, nil
+	}
+
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return gotifyMessage{}, errors.New("invalid form")
+	}
+	m.Title = r.FormValue("title")
+	m.Message = r.FormValue("message")
+	if v := r.FormValue("priority"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return gotifyMessage{}, errors.New("priority must be a number")
+		}
+		m.Priority = &p
+	}
+	return m, nil
+}
+
+// gotifyRequest maps a Gotify message onto a notification to the app's
+// topic. Priorities 0-3 are sent silently with low urgency (very-low for 0),
+// 4-7 (or none) with normal urgency and 8-10 with high urgency. The extras
+// client::notification click.url and bigImageUrl set the click target and
+// image.
+func gotifyRequest(m gotifyMessage, app GotifyApp) NotifyRequest {
+	req := NotifyRequest{
+		Topic:    app.Topic,
+		Title:    m.Title,
+		Body:     m.Message,
+		Truncate: true,
+	}
+	if req.Title == "" {
+		req.Title = app.Name
+	}
+
+	silent := true
+	switch p := m.Priority; {
+	case p == nil || *p >= 4 && *p <= 7:
+		req.Urgency = string(webpush.UrgencyNormal)
+	case *p <= 0:
+		req.Urgency = string(webpush.UrgencyVeryLow)
+		req.Silent = &silent
+	case *p <= 3:
+		req.Urgency = string(webpush.UrgencyLow)
+		req.Silent = &silent
+	default:
+		req.Urgency = string(webpush.UrgencyHigh)
+	}
+
+	if n, ok := m.Extras["client::notification"].(map[string]any); ok {
+		if click, ok := n["click"].(map[string]any); ok {
+			if u, ok := click["url"].(string); ok && u != "" {
+				req.Data = map[string]any{"url": u}
+				if isHTTPSURL(u) {
+					req.Navigate = u
+				}
+			}
+		}
+		if image, ok := n["bigImageUrl"].(string); ok {
+			req.Image = image
+		}
+	}
+	return req
+}
+
+// HandleGotifyMessage publishes a message to the topic of the app whose
+// token authenticates the request, as Gotify's POST /message does.
+func (s *Server) HandleGotifyMessage(w http.ResponseWriter, r *http.Request) {
+	app, err := GetGotifyAppByToken(s.DB, gotifyToken(r))
+	if errors.Is(err, errGotifyAppNotFound) {
+		writeError(w, http.StatusUnauthorized, "you need to provide a valid access token")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get app")
+		return
+	}
+
+	m, err := decodeGotifyMessage(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if m.Message == "" {
+		writeError(w, http.StatusBadRequest, "message is required")
+		return
+	}
+
+	req := gotifyRequest(m, app)
+	if _, ok := s.checkNotifyRequest(w, &req); !ok {
+		return
+	}
+	result := s.SendNotifications(req)
+
+	// Gotify clients expect numeric message IDs: use the notification's row
+	// number. The message is already sent, so a missing record (its error
+	// is logged by SendNotifications) must not fail the request and cause
+	// a retry: the ID is then 0.
+	if err := s.DB.QueryRow(`SELECT rowid FROM notifications WHERE id = ?`, result.ID).Scan(&m.ID); err != nil {
+		log.Printf("error getting gotify message id for notification %s: %v", result.ID, err)
+		m.ID = 0
+	}
+	m.AppID = app.ID
+	m.Title = req.Title
+	if m.Priority == nil {
+		p := 5
+		m.Priority = &p
+	}
+	m.Date = time.Now().UTC().Format(time.RFC3339)
+	writeJSON(w, http.StatusOK, m)
+}
+
+// HandleListGotifyApps returns all Gotify apps and their tokens (admin).
+func (s *Server) HandleListGotifyApps(w http.ResponseWriter, r *http.Request) {
+	apps, err := ListGotifyApps(s.DB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list apps")
+		return
+	}
+	if apps == nil {
+		apps = []GotifyApp{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"apps": apps})
+}
+
+// HandlePostGotifyApp creates a Gotify app publishing to a topic (admin).
+func (s *Server) HandlePostGotifyApp(w http.ResponseWriter, r *http.Request) {
+	var app GotifyApp
+	if err := json.NewDecoder(r.Body).Decode(&app); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if app.Name == "" || app.Topic == "" {
+		writeError(w, http.StatusBadRequest, "name and topic are required")
+		return
+	}
+	if reservedTopics[app.Topic] {
+		writeError(w, http.StatusBadRequest, reservedTopicMsg)
+		return
+	}
+
+	created, err := CreateGotifyApp(s.DB, app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save app")
+		return
+	}
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// HandleDeleteGotifyApp removes a Gotify app, revoking its token (admin).
+func (s *Server) HandleDeleteGotifyApp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid app id")
+		return
+	}
+	if err := DeleteGotifyApp(s.DB, id); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete app")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
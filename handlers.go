@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -20,7 +21,12 @@ type Server struct {
 	VAPIDContact    string
 	AdminKey        string
 	WelcomeMessage  string
+	FrequencyCap    FrequencyCap
 	WG              sync.WaitGroup
+
+	events   eventBus
+	caps     capReservations
+	webhooks webhookCache
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -42,6 +48,7 @@ func (s *Server) HandleGetVAPIDPublicKey(w http.ResponseWriter, r *http.Request)
 func (s *Server) HandlePostSubscription(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Topic        string `json:"topic"`
+		Locale       string `json:"locale"`
 		Subscription struct {
 			Endpoint string `json:"endpoint"`
 			Keys     struct {
@@ -60,12 +67,26 @@ func (s *Server) HandlePostSubscription(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusBadRequest, "subscription.endpoint, subscription.keys.p256dh, and subscription.keys.auth are required")
 		return
 	}
+	if reservedTopics[body.Topic] {
+		writeError(w, http.StatusBadRequest, reservedTopicMsg)
+		return
+	}
+	if body.Locale != "" && !localeRe.MatchString(body.Locale) {
+		writeError(w, http.StatusBadRequest, "locale must be a BCP 47 language tag (e.g. \"fr-CA\")")
+		return
+	}
 
 	id, created, err := UpsertSubscription(s.DB, body.Topic, body.Subscription.Endpoint, body.Subscription.Keys.P256dh, body.Subscription.Keys.Auth)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to save subscription")
 		return
 	}
+	if body.Locale != "" {
+		if err := SetSubscriptionLocale(s.DB, body.Subscription.Endpoint, body.Locale); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save subscription")
+			return
+		}
+	}
 
 	status := http.StatusOK
 	if created {
@@ -73,6 +94,10 @@ func (s *Server) HandlePostSubscription(w http.ResponseWriter, r *http.Request)
 	}
 	writeJSON(w, status, map[string]string{"id": id})
 
+	if created {
+		s.publishEvent(eventSubscriptionCreated, SubscriptionEvent{ID: id, Topic: body.Topic, Endpoint: body.Subscription.Endpoint})
+	}
+
 	if created && s.WelcomeMessage != "" {
 		sub := Subscription{
 			ID:        id,
@@ -84,7 +109,7 @@ func (s *Server) HandlePostSubscription(w http.ResponseWriter, r *http.Request)
 		go func() {
 			defer s.WG.Done()
 			time.Sleep(1 * time.Second)
-			sendToSubscriptions(s.DB, []Subscription{sub}, NotifyRequest{Title: s.WelcomeMessage}, s.VAPIDPublicKey, s.VAPIDPrivateKey, s.VAPIDContact)
+			s.sendToSubscriptions([]Subscription{sub}, NotifyRequest{Title: s.WelcomeMessage})
 		}()
 	}
 }
@@ -106,14 +131,60 @@ func (s *Server) HandleDeleteSubscriptionByEndpoint(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := DeleteSubscriptionByEndpoint(s.DB, body.Endpoint, body.Topic); err != nil {
+	removed, err := DeleteSubscriptionByEndpoint(s.DB, body.Endpoint, body.Topic)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to delete subscription")
 		return
 	}
+	for _, sub := range removed {
+		s.publishEvent(eventSubscriptionRemoved, SubscriptionEvent{ID: sub.ID, Topic: sub.Topic, Endpoint: sub.Endpoint, Reason: "unsubscribed"})
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleRotateSubscription migrates all topics of an old subscription to a new
+// one, as needed when the browser fires pushsubscriptionchange (public).
+func (s *Server) HandleRotateSubscription(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		OldEndpoint  string `json:"oldEndpoint"`
+		Subscription struct {
+			Endpoint string `json:"endpoint"`
+			Keys     struct {
+				P256dh string `json:"p256dh"`
+				Auth   string `json:"auth"`
+			} `json:"keys"`
+		} `json:"subscription"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	if body.OldEndpoint == "" {
+		writeError(w, http.StatusBadRequest, "oldEndpoint is required")
+		return
+	}
+	if body.Subscription.Endpoint == "" || body.Subscription.Keys.P256dh == "" || body.Subscription.Keys.Auth == "" {
+		writeError(w, http.StatusBadRequest, "subscription.endpoint, subscription.keys.p256dh, and subscription.keys.auth are required")
+		return
+	}
+
+	// An unchanged endpoint (only the keys were renewed) is a key-only update.
+	migrated, err := RotateSubscription(s.DB, body.OldEndpoint, body.Subscription.Endpoint, body.Subscription.Keys.P256dh, body.Subscription.Keys.Auth)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to rotate subscription")
+		return
+	}
+	if migrated == 0 {
+		writeError(w, http.StatusNotFound, "no subscription found for oldEndpoint")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"migrated": migrated})
+}
+
 // HandleListSubscriptions returns all subscriptions (admin, no keys).
 func (s *Server) HandleListSubscriptions(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
@@ -136,14 +207,52 @@ func (s *Server) HandleDeleteSubscriptionByID(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if err := DeleteSubscriptionByID(s.DB, id); err != nil {
+	removed, err := DeleteSubscriptionByID(s.DB, id)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to delete subscription")
 		return
 	}
+	for _, sub := range removed {
+		s.publishEvent(eventSubscriptionRemoved, SubscriptionEvent{ID: sub.ID, Topic: sub.Topic, Endpoint: sub.Endpoint, Reason: "admin"})
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// checkNotifyRequest renders req's template, validates req and enforces the
+// push payload size limit before fan-out, truncating the body if
+// req.Truncate is set. On failure it writes the error
+// response and returns ok=false.
+func (s *Server) checkNotifyRequest(w http.ResponseWriter, req *NotifyRequest) (truncated, ok bool) {
+	if err := applyTemplate(s.DB, req); errors.Is(err, errTemplateNotFound) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("template %q not found", req.Template))
+		return false, false
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false, false
+	}
+
+	if err := validateNotifyRequest(*req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false, false
+	}
+
+	truncated, err := fitPayloads(req)
+	var tooLarge *PayloadTooLargeError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{
+			"error": err.Error(),
+			"size":  tooLarge.Size,
+		})
+		return false, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to build push payload")
+		return false, false
+	}
+	return truncated, true
+}
+
 // HandleNotify sends push notifications to matching subscriptions (admin).
 func (s *Server) HandleNotify(w http.ResponseWriter, r *http.Request) {
 	var req NotifyRequest
@@ -152,15 +261,32 @@ func (s *Server) HandleNotify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Title == "" {
-		writeError(w, http.StatusBadRequest, "title is required")
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+
+	if req.DryRun {
+		s.writePreview(w, req, truncated)
 		return
 	}
 
-	result := SendNotifications(s.DB, req, s.VAPIDPublicKey, s.VAPIDPrivateKey, s.VAPIDContact, &s.WG)
+	result := s.SendNotifications(req)
+	result.Truncated = truncated
+	if !s.verbose(r) {
+		result.Deliveries = nil
+	}
 	writeJSON(w, http.StatusOK, result)
 }
 
+// verbose reports whether the request asks for per-subscription delivery
+// results (?verbose=true). They expose subscription IDs, so only admin
+// requests get them, also on the public endpoints.
+func (s *Server) verbose(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	return v && s.isAdmin(r)
+}
+
 // HandleTopicNotify sends push notifications to a topic's subscribers (public).
 // The topic name acts as a capability token — knowing the topic grants permission to notify it.
 func (s *Server) HandleTopicNotify(w http.ResponseWriter, r *http.Request) {
@@ -175,14 +301,32 @@ func (s *Server) HandleTopicNotify(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "invalid JSON")
 		return
 	}
+	if len(req.SubscriptionIDs) > 0 {
+		writeError(w, http.StatusBadRequest, "subscription_ids is only supported by POST /notify")
+		return
+	}
 
-	if req.Title == "" {
-		writeError(w, http.StatusBadRequest, "title is required")
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
 		return
 	}
 
 	req.Topic = topic
-	result := SendNotifications(s.DB, req, s.VAPIDPublicKey, s.VAPIDPrivateKey, s.VAPIDContact, &s.WG)
+	if req.DryRun {
+		// The preview reveals the topic's audience, so it stays admin-only.
+		if !s.isAdmin(r) {
+			writeError(w, http.StatusUnauthorized, "dry_run requires the admin key")
+			return
+		}
+		s.writePreview(w, req, truncated)
+		return
+	}
+
+	result := s.SendNotifications(req)
+	result.Truncated = truncated
+	if !s.verbose(r) {
+		result.Deliveries = nil
+	}
 	writeJSON(w, http.StatusOK, result)
 }
 
@@ -227,11 +371,16 @@ func (s *Server) HandlePurgeDeliveryLog(w http.ResponseWriter, r *http.Request)
 	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
 }
 
+// isAdmin reports whether r carries the admin key as a bearer token.
+func (s *Server) isAdmin(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") && strings.TrimPrefix(auth, "Bearer ") == s.AdminKey
+}
+
 // requireAuth wraps a handler with bearer token authentication.
 func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != s.AdminKey {
+		if !s.isAdmin(r) {
 			writeError(w, http.StatusUnauthorized, "unauthorized")
 			return
 		}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Hook is a named inbound webhook: a secret, and a mapping from the JSON
+// payloads posted to /hooks/{name} onto notify requests.
+//
+// The mapping is shaped like a NotifyRequest. Its string values (at any
+// depth) are JSONPath expressions when they start with "$", such as
+// "$.alert.title" or "$.items[0]['display-name']", which take the payload
+// value they point to, or nothing if there is none; text/templates when they
+// contain "{{", rendered with the payload; and literals otherwise.
+type Hook struct {
+	Name      string         `json:"name"`
+	Secret    string         `json:"secret,omitempty"`
+	Mapping   map[string]any `json:"mapping"`
+	CreatedAt string         `json:"created_at"`
+	UpdatedAt string         `json:"updated_at"`
+}
+
+var errHookNotFound = errors.New("hook not found")
+
+// hookMaxBody is the largest payload accepted by an inbound hook.
+const hookMaxBody = 1 << 20
+
+// notifyRequestFields are the JSON names of the NotifyRequest fields a hook
+// mapping may set. dry_run is left out: a hook always sends.
+var notifyRequestFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeFor[NotifyRequest]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && name != "dry_run" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// UpsertHook creates or replaces a hook. A new hook without a secret gets a
+// generated one; an existing hook keeps its secret unless a new one is given.
+// Returns whether it was created.
+func UpsertHook(db *sql.DB, h Hook) (created bool, err error) {
+	mapping, err := json.Marshal(h.Mapping)
+	if err != nil {
+		return false, fmt.Errorf("marshal hook mapping: %w", err)
+	}
+	secret := h.Secret
+	if secret == "" {
+		secret = randomID()
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM hooks WHERE name = ?)`, h.Name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("check hook: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO hooks (name, secret, mapping)
+		VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			secret = CASE WHEN ? = '' THEN hooks.secret ELSE excluded.secret END,
+			mapping = excluded.mapping,
+			updated_at = datetime('now')
+	`, h.Name, secret, string(mapping), h.Secret)
+	if err != nil {
+		return false, fmt.Errorf("upsert hook: %w", err)
+	}
+	return !exists, nil
+}
+
+func scanHook(row interface{ Scan(...any) error }) (Hook, error) {
+	var h Hook
+	var mapping string
+	if err := row.Scan(&h.Name, &h.Secret, &mapping, &h.CreatedAt, &h.UpdatedAt); err != nil {
+		return Hook{}, err
+	}
+	if err := json.Unmarshal([]byte(mapping), &h.Mapping); err != nil {
+		return Hook{}, fmt.Errorf("decode hook mapping: %w", err)
+	}
+	return h, nil
+}
+
+// GetHook returns the named hook (including its secret), or errHookNotFound.
+func GetHook(db *sql.DB, name string) (Hook, error) {
+	h, err := scanHook(db.QueryRow(`SELECT name, secret, mapping, created_at, updated_at FROM hooks WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Hook{}, errHookNotFound
+	}
+	if err != nil {
+		return Hook{}, fmt.Errorf("query hook: %w", err)
+	}
+	return h, nil
+}
+
+// ListHooks returns all hooks (including their secrets) ordered by name.
+func ListHooks(db *sql.DB) ([]Hook, error) {
+	rows, err := db.Query(`SELECT name, secret, mapping, created_at, updated_at FROM hooks ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("query hooks: %w", err)
+	}
+	defer rows.Close()
+
+	var hooks []Hook
+	for rows.Next() {
+		h, err := scanHook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan hook: %w", err)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteHook removes a hook by name.
+func DeleteHook(db *sql.DB, name string) error {
+	_, err := db.Exec(`DELETE FROM hooks WHERE name = ?`, name)
+	return err
+}
+
+// parseJSONPath parses a JSONPath made of child names and array indexes:
+// $.a.b, $.a[0], $['a-b']. Steps are map keys (string) or indexes (int).
+func parseJSONPath(path string) ([]any, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("invalid JSONPath %q: must start with $", path)
+	}
+	var steps []any
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" || name == "*" {
+				return nil, fmt.Errorf("invalid JSONPath %q: expected a name after '.'", path)
+			}
+			steps = append(steps, name)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q: unclosed '['", path)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+			} else if i, err := strconv.Atoi(inner); err == nil && i >= 0 {
+				steps = append(steps, i)
+			} else {
+				return nil, fmt.Errorf("invalid JSONPath %q: expected a quoted name or an index in [%s]", path, inner)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q: unexpected %q", path, rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSONPath returns the value of v at path. ok is false when the path
+// leads nowhere.
+func lookupJSONPath(v any, path string) (value any, ok bool, err error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			m, isMap := v.(map[string]any)
+			if !isMap {
+				return nil, false, nil
+			}
+			if v, ok = m[step]; !ok {
+				return nil, false, nil
+			}
+		case int:
+			a, isArray := v.([]any)
+			if !isArray || step >= len(a) {
+				return nil, false, nil
+			}
+			v = a[step]
+		}
+	}
+	return v, v != nil, nil
+}
+
+// mapValue evaluates a mapping value against a payload, recursing into
+// objects and arrays. Object keys whose JSONPath leads nowhere are left out.
+func mapValue(name string, v any, payload map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "$") {
+			value, _, err := lookupJSONPath(payload, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			return value, nil
+		}
+		return renderString(name, v, payload)
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			r, err := mapValue(name+"."+k, e, payload)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				out[k] = r
+			}
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			r, err := mapValue(fmt.Sprintf("%s[%d]", name, i), e, payload)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// Map returns the notify request the hook's mapping builds from payload.
+func (h Hook) Map(payload map[string]any) (NotifyRequest, error) {
+	mapped := make(map[string]any, len(h.Mapping))
+	for field, v := range h.Mapping {
+		r, err := mapValue(field, v, payload)
+		if err != nil {
+			return NotifyRequest{}, err
+		}
+		if r != nil {
+			mapped[field] = r
+		}
+	}
+
+	data, err := json.Marshal(mapped)
+	if err != nil {
+		return NotifyRequest{}, fmt.Errorf("encode mapped request: %w", err)
+	}
+	var req NotifyRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return NotifyRequest{}, fmt.Errorf("mapped request: %w", err)
+	}
+	return req, nil
+}
+
+// validate checks that the mapping only sets NotifyRequest fields and that
+// all its JSONPaths and templates parse.
+func (h Hook) validate() error {
+	if len(h.Mapping) == 0 {
+		return fmt.Errorf("mapping is required")
+	}
+	var check func(name string, v any) error
+	check = func(name string, v any) error {
+		switch v := v.(type) {
+		case string:
+			if strings.HasPrefix(v, "$") {
+				_, err := parseJSONPath(v)
+				return err
+			}
+			_, err := template.New(name).Parse(v)
+			return err
+		case map[string]any:
+			for k, e := range v {
+				if err := check(name+"."+k, e); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for i, e := range v {
+				if err := check(fmt.Sprintf("%s[%d]", name, i), e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for field, v := range h.Mapping {
+		if !notifyRequestFields[field] {
+			return fmt.Errorf("mapping: unknown notify request field %q", field)
+		}
+		if err := check(field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeHookPayload decodes a hook payload, which must be a JSON object.
+// Numbers are kept as written, so that templates render them unchanged.
+func decodeHookPayload(body io.Reader) (map[string]any, error) {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	var payload map[string]any
+	if err := dec.Decode(&payload); err != nil || payload == nil {
+		return nil, errors.New("payload must be a JSON object")
+	}
+	return payload, nil
+}
+
+// hookAuthorized reports whether r carries the hook's secret: as a bearer
+// token, the X-Hook-Secret header or the secret query parameter, or as the
+// X-Webhook-Signature HMAC of the body, the way the server signs its own
+// webhooks.
+func hookAuthorized(r *http.Request, secret string, body []byte) bool {
+	if sig := r.Header.Get("X-Webhook-Signature"); sig != "" {
+		return hmac.Equal([]byte(sig), []byte(signWebhookPayload(secret, body)))
+	}
+	given := r.Header.Get("X-Hook-Secret")
+	if given == "" {
+		given, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if given == "" {
+		given = r.URL.Query().Get("secret")
+	}
+	return given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// HandleHook receives a payload on an inbound hook and sends the
+// notification its mapping builds (public, authenticated by the hook's
+// secret).
+func (s *Server) HandleHook(w http.ResponseWriter, r *http.Request) {
+	h, err := GetHook(s.DB, r.PathValue("name"))
+	if errors.Is(err, errHookNotFound) {
+		writeError(w, http.StatusNotFound, "hook not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get hook")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, hookMaxBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if len(body) > hookMaxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("payload exceeds %d bytes", hookMaxBody))
+		return
+	}
+	if !hookAuthorized(r, h.Secret, body) {
+		writeError(w, http.StatusUnauthorized, "invalid hook secret")
+		return
+	}
+
+	payload, err := decodeHookPayload(bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := h.Map(payload)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+
+	result := s.SendNotifications(req)
+	result.Truncated = truncated
+	if !s.verbose(r) {
+		result.Deliveries = nil
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandleListHooks returns all hooks, without their secrets (admin).
+func (s *Server) HandleListHooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := ListHooks(s.DB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list hooks")
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	if hooks == nil {
+		hooks = []Hook{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"hooks": hooks})
+}
+
+// HandleGetHook returns a single hook, with its secret (admin).
+func (s *Server) HandleGetHook(w http.ResponseWriter, r *http.Request) {
+	h, err := GetHook(s.DB, r.PathValue("name"))
+	if errors.Is(err, errHookNotFound) {
+		writeError(w, http.StatusNotFound, "hook not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get hook")
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// HandlePutHook creates or replaces a hook (admin).
+func (s *Server) HandlePutHook(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !templateNameRe.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "hook name must be 1-64 letters, digits, '.', '_' or '-'")
+		return
+	}
+
+	var h Hook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	h.Name = name
+
+	if err := h.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created, err := UpsertHook(s.DB, h)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save hook")
+		return
+	}
+
+	saved, err := GetHook(s.DB, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get hook")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, saved)
+}
+
+// HandleDeleteHook removes a hook (admin).
+func (s *Server) HandleDeleteHook(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteHook(s.DB, r.PathValue("name")); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete hook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleTestHook maps a sample payload with a hook and returns the notify
+// request it builds, with its stored template applied, without sending
+// anything (admin). A request that would be rejected is returned with the
+// reason in error.
+func (s *Server) HandleTestHook(w http.ResponseWriter, r *http.Request) {
+	h, err := GetHook(s.DB, r.PathValue("name"))
+	if errors.Is(err, errHookNotFound) {
+		writeError(w, http.StatusNotFound, "hook not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get hook")
+		return
+	}
+
+	payload, err := decodeHookPayload(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req, err := h.Map(payload)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := make(map[string]any)
+	if err := applyTemplate(s.DB, &req); errors.Is(err, errTemplateNotFound) {
+		result["error"] = fmt.Sprintf("template %q not found", req.Template)
+	} else if err != nil {
+		result["error"] = err.Error()
+	} else if err := validateNotifyRequest(req); err != nil {
+		result["error"] = err.Error()
+	}
+	result["request"] = req
+	writeJSON(w, http.StatusOK, result)
+}
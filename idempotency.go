@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// idempotencyRetention is how long a stored Idempotency-Key result is replayed.
+const idempotencyRetention = 24 * time.Hour
+
+// idempotencyLease is how long a key stays reserved by a request that never
+// completed (e.g. the server restarted mid-request) before a retry may
+// claim it.
+const idempotencyLease = 10 * time.Minute
+
+// idempotencyRecord is a stored Idempotency-Key. Status is 0 while the
+// original request is still being processed.
+type idempotencyRecord struct {
+	RequestHash string
+	Status      int
+	Response    string
+}
+
+// ReserveIdempotencyKey claims key within scope for a request with the given
+// hash. If the key is already in use, it returns the existing record and
+// false. Expired keys, and reservations older than idempotencyLease that
+// never completed, are treated as unused.
+func ReserveIdempotencyKey(db *sql.DB, scope, key, hash string) (idempotencyRecord, bool, error) {
+	now := time.Now().UTC()
+	cutoff := now.Add(-idempotencyRetention).Format("2006-01-02 15:04:05")
+	leaseCutoff := now.Add(-idempotencyLease).Format("2006-01-02 15:04:05")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return idempotencyRecord{}, false, fmt.Errorf("begin reserve idempotency key: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE scope = ? AND key = ? AND (created_at < ? OR status = 0 AND created_at < ?)`,
+		scope, key, cutoff, leaseCutoff); err != nil {
+		return idempotencyRecord{}, false, fmt.Errorf("expire idempotency key: %w", err)
+	}
+
+	var rec idempotencyRecord
+	err = tx.QueryRow(`SELECT request_hash, status, response FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key).
+		Scan(&rec.RequestHash, &rec.Status, &rec.Response)
+	if err == nil {
+		return rec, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return idempotencyRecord{}, false, fmt.Errorf("query idempotency key: %w", err)
+	}
+
+	if _, err := tx.Exec(`INSERT INTO idempotency_keys (scope, key, request_hash) VALUES (?, ?, ?)`, scope, key, hash); err != nil {
+		return idempotencyRecord{}, false, fmt.Errorf("insert idempotency key: %w", err)
+	}
+	return idempotencyRecord{}, true, tx.Commit()
+}
+
+// CompleteIdempotencyKey stores the response of the request that reserved key.
+func CompleteIdempotencyKey(db *sql.DB, scope, key string, status int, response string) error {
+	_, err := db.Exec(`UPDATE idempotency_keys SET status = ?, response = ? WHERE scope = ? AND key = ?`, status, response, scope, key)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a reserved key so the request can be retried.
+func ReleaseIdempotencyKey(db *sql.DB, scope, key string) error {
+	_, err := db.Exec(`DELETE FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// PurgeIdempotencyKeys deletes keys older than the given duration.
+func PurgeIdempotencyKeys(db *sql.DB, olderThan time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-olderThan).Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// recordingWriter captures the status and body written by a handler.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotent makes a handler honour the Idempotency-Key request header.
+// The first successful (2xx) response for a key is stored and replayed for
+// later requests with the same key and body; reusing the key with a
+// different body, or while the first request is in flight, is a 409.
+// Failed requests, including handler panics, release the key so they can be
+// retried.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		scope := r.Method + " " + r.URL.Path
+
+		rec, reserved, err := ReserveIdempotencyKey(s.DB, scope, key, hash)
+		if err != nil {
+			log.Printf("idempotency key error: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to check idempotency key")
+			return
+		}
+		if !reserved {
+			switch {
+			case rec.RequestHash != hash:
+				writeError(w, http.StatusConflict, "Idempotency-Key was already used with a different request body")
+			case rec.Status == 0:
+				writeError(w, http.StatusConflict, "a request with this Idempotency-Key is still in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				io.WriteString(w, rec.Response)
+			}
+			return
+		}
+
+		finished := false
+		defer func() {
+			if !finished {
+				// The handler panicked: let the request be retried.
+				if err := ReleaseIdempotencyKey(s.DB, scope, key); err != nil {
+					log.Printf("idempotency key error: %v", err)
+				}
+			}
+		}()
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next(rw, r)
+		finished = true
+
+		if rw.status >= 200 && rw.status < 300 {
+			err = CompleteIdempotencyKey(s.DB, scope, key, rw.status, rw.body.String())
+		} else {
+			err = ReleaseIdempotencyKey(s.DB, scope, key)
+		}
+		if err != nil {
+			log.Printf("idempotency key error: %v", err)
+		}
+	}
+}
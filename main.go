@@ -10,6 +10,7 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // subscriber timezones for quiet hours; the container has no zoneinfo
 )
 
 func main() {
@@ -33,6 +34,7 @@ func main() {
 	port := os.Getenv("PORT")
 	corsOrigin := os.Getenv("CORS_ORIGIN")
 	welcomeMessage := os.Getenv("WELCOME_MESSAGE")
+	frequencyCap := os.Getenv("FREQUENCY_CAP")
 
 	// Defaults.
 	if dbPath == "" {
@@ -56,6 +58,11 @@ func main() {
 		log.Fatal("ADMIN_KEY is required")
 	}
 
+	freqCap, err := parseFrequencyCap(frequencyCap)
+	if err != nil {
+		log.Fatalf("invalid FREQUENCY_CAP: %v", err)
+	}
+
 	// Parse VAPID keys to validate them.
 	if _, err := ParseVAPIDKeys(vapidPublicKey, vapidPrivateKey); err != nil {
 		log.Fatalf("invalid VAPID keys: %v", err)
@@ -76,18 +83,24 @@ func main() {
 		VAPIDContact:    vapidContact,
 		AdminKey:        adminKey,
 		WelcomeMessage:  welcomeMessage,
+		FrequencyCap:    freqCap,
 	}
 
 	httpServer := &http.Server{
 		Addr:    ":" + port,
 		Handler: srv.NewRouter(corsOrigin),
 	}
+	httpServer.RegisterOnShutdown(srv.CloseEventStreams)
 
 	// Start automatic delivery log purge.
 	purgeCtx, purgeCancel := context.WithCancel(context.Background())
 	defer purgeCancel()
 	go purgeDeliveryLogLoop(purgeCtx, db)
 
+	// Start delivery of notifications deferred by quiet hours.
+	go srv.deliverDeferredLoop(purgeCtx)
+	go srv.flushDigestsLoop(purgeCtx)
+
 	// Start listening in a goroutine.
 	go func() {
 		log.Printf("listening on :%s", port)
@@ -118,8 +131,9 @@ func main() {
 	log.Println("shutdown complete")
 }
 
-// purgeDeliveryLogLoop purges delivery log entries older than 30 days,
-// once at startup and then every 24 hours.
+// purgeDeliveryLogLoop purges delivery log entries, notification records and
+// webhook deliveries older than 30 days, and expired idempotency keys, once
+// at startup and then every 24 hours.
 func purgeDeliveryLogLoop(ctx context.Context, db *sql.DB) {
 	const retention = 30 * 24 * time.Hour
 	const interval = 24 * time.Hour
@@ -131,6 +145,15 @@ func purgeDeliveryLogLoop(ctx context.Context, db *sql.DB) {
 		} else if deleted > 0 {
 			log.Printf("purged %d delivery log entries older than 30d", deleted)
 		}
+		if _, err := PurgeNotifications(db, retention); err != nil {
+			log.Printf("notification purge error: %v", err)
+		}
+		if _, err := PurgeWebhookDeliveries(db, retention); err != nil {
+			log.Printf("webhook delivery purge error: %v", err)
+		}
+		if _, err := PurgeIdempotencyKeys(db, idempotencyRetention); err != nil {
+			log.Printf("idempotency key purge error: %v", err)
+		}
 	}
 
 	purge()
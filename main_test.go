@@ -1,12 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestGenerateAndParseVAPIDKeys(t *testing.T) {
@@ -117,7 +130,7 @@ func TestMultiTopicSubscription(t *testing.T) {
 	}
 
 	// Delete only topicA subscription.
-	if err := DeleteSubscriptionByEndpoint(db, endpoint, "topicA"); err != nil {
+	if _, err := DeleteSubscriptionByEndpoint(db, endpoint, "topicA"); err != nil {
 		t.Fatalf("DeleteSubscriptionByEndpoint topicA: %v", err)
 	}
 
@@ -133,7 +146,7 @@ func TestMultiTopicSubscription(t *testing.T) {
 	// Delete all subscriptions for endpoint (no topic).
 	// Re-add topicA first.
 	UpsertSubscription(db, "topicA", endpoint, "key", "auth")
-	if err := DeleteSubscriptionByEndpoint(db, endpoint, ""); err != nil {
+	if _, err := DeleteSubscriptionByEndpoint(db, endpoint, ""); err != nil {
 		t.Fatalf("DeleteSubscriptionByEndpoint all: %v", err)
 	}
 	all, _ := GetSubscriptionsByTopic(db, "")
@@ -144,6 +157,1440 @@ func TestMultiTopicSubscription(t *testing.T) {
 	}
 }
 
+func TestRotateSubscription(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer db.Close()
+
+	oldEndpoint := "https://push.example.com/old"
+	newEndpoint := "https://push.example.com/new"
+
+	idA, _, _ := UpsertSubscription(db, "topicA", oldEndpoint, "key", "auth")
+	oldB, _, _ := UpsertSubscription(db, "topicB", oldEndpoint, "key", "auth")
+	SetSubscriptionLocale(db, oldEndpoint, "fr")
+	DeferNotification(db, oldB, NotifyRequest{Title: "Deferred"}, time.Now().Add(-time.Minute))
+	// The new endpoint already knows topicB: the old row must be dropped, not
+	// duplicated, handing over its preferences and deferred notifications.
+	idB, _, _ := UpsertSubscription(db, "topicB", newEndpoint, "stale-key", "stale-auth")
+
+	migrated, err := RotateSubscription(db, oldEndpoint, newEndpoint, "new-key", "new-auth")
+	if err != nil {
+		t.Fatalf("RotateSubscription: %v", err)
+	}
+	if migrated != 2 {
+		t.Errorf("expected 2 migrated, got %d", migrated)
+	}
+
+	all, _ := GetSubscriptionsByTopic(db, "")
+	if len(all) != 2 {
+		t.Fatalf("expected 2 subscriptions after rotate, got %d", len(all))
+	}
+	for _, s := range all {
+		if s.Endpoint != newEndpoint {
+			t.Errorf("expected endpoint %q, got %q", newEndpoint, s.Endpoint)
+		}
+		if s.KeyP256dh != "new-key" || s.KeyAuth != "new-auth" {
+			t.Errorf("expected rotated keys, got %q/%q", s.KeyP256dh, s.KeyAuth)
+		}
+		if s.Topic == "topicA" && s.ID != idA {
+			t.Errorf("expected topicA to keep id %q, got %q", idA, s.ID)
+		}
+		if s.Topic == "topicB" && s.ID != idB {
+			t.Errorf("expected topicB to keep id %q, got %q", idB, s.ID)
+		}
+		if s.Locale != "fr" {
+			t.Errorf("expected %s to keep locale fr, got %q", s.Topic, s.Locale)
+		}
+	}
+	due, err := TakeDueDeferred(db, time.Now())
+	if err != nil {
+		t.Fatalf("TakeDueDeferred: %v", err)
+	}
+	if len(due) != 1 || due[0].Subscription.ID != idB {
+		t.Errorf("expected the deferred notification to move to %q, got %+v", idB, due)
+	}
+
+	// Rotating to the same endpoint only updates the keys.
+	migrated, err = RotateSubscription(db, newEndpoint, newEndpoint, "newer-key", "newer-auth")
+	if err != nil {
+		t.Fatalf("RotateSubscription (same endpoint): %v", err)
+	}
+	all, _ = GetSubscriptionsByTopic(db, "")
+	if migrated != 2 || len(all) != 2 {
+		t.Fatalf("expected 2 migrated and kept, got %d and %d", migrated, len(all))
+	}
+	for _, s := range all {
+		if s.KeyP256dh != "newer-key" || s.KeyAuth != "newer-auth" {
+			t.Errorf("expected updated keys, got %q/%q", s.KeyP256dh, s.KeyAuth)
+		}
+	}
+
+	// Unknown old endpoint migrates nothing.
+	migrated, err = RotateSubscription(db, "https://push.example.com/unknown", newEndpoint, "k", "a")
+	if err != nil {
+		t.Fatalf("RotateSubscription (unknown): %v", err)
+	}
+	if migrated != 0 {
+		t.Errorf("expected 0 migrated for unknown endpoint, got %d", migrated)
+	}
+}
+
+func TestSubscriptionLocale(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+
+	endpoint := "https://push.example.com/locale"
+	UpsertSubscription(db, "topicA", endpoint, "key", "auth")
+	UpsertSubscription(db, "topicB", endpoint, "key", "auth")
+	if err := SetSubscriptionLocale(db, endpoint, "fr-CA"); err != nil {
+		t.Fatalf("SetSubscriptionLocale: %v", err)
+	}
+	db.Close()
+
+	// Reopening runs the migrations again on an up-to-date schema.
+	db, err = OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB (reopen): %v", err)
+	}
+	defer db.Close()
+
+	all, _ := GetSubscriptionsByTopic(db, "")
+	if len(all) != 2 {
+		t.Fatalf("expected 2 subscriptions, got %d", len(all))
+	}
+	for _, s := range all {
+		if s.Locale != "fr-CA" {
+			t.Errorf("topic %q: expected locale fr-CA, got %q", s.Topic, s.Locale)
+		}
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	localizations := map[string]Localization{
+		"fr":    {Title: "Bonjour"},
+		"de-AT": {Title: "Servus"},
+	}
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"fr", "fr"},
+		{"fr-CA", "fr"},
+		{"FR-ca", "fr"},
+		{"de-AT", "de-AT"},
+		{"de", ""},
+		{"en-US", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := matchLocale(localizations, tt.locale); got != tt.want {
+			t.Errorf("matchLocale(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+
+	req := NotifyRequest{Title: "Hello", Body: "Default", Lang: "en", Localizations: localizations}
+	fr := localize(req, "fr")
+	if fr.Title != "Bonjour" || fr.Body != "" || fr.Lang != "fr" {
+		t.Errorf("unexpected French variant: %+v", fr)
+	}
+	if def := localize(req, ""); def.Title != "Hello" || def.Lang != "en" {
+		t.Errorf("unexpected default variant: %+v", def)
+	}
+}
+
+func TestQuietUntil(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	tests := []struct {
+		name      string
+		sub       Subscription
+		at        time.Time
+		wantQuiet bool
+		wantUntil time.Time
+	}{
+		{"NoQuietHours", Subscription{}, time.Date(2025, 1, 1, 3, 0, 0, 0, time.UTC), false, time.Time{}},
+		{"BeforeMidnight", Subscription{QuietStart: "22:00", QuietEnd: "07:00"},
+			time.Date(2025, 1, 1, 23, 0, 0, 0, time.UTC), true, time.Date(2025, 1, 2, 7, 0, 0, 0, time.UTC)},
+		{"AfterMidnight", Subscription{QuietStart: "22:00", QuietEnd: "07:00"},
+			time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC), true, time.Date(2025, 1, 2, 7, 0, 0, 0, time.UTC)},
+		{"WindowEnd", Subscription{QuietStart: "22:00", QuietEnd: "07:00"},
+			time.Date(2025, 1, 2, 7, 0, 0, 0, time.UTC), false, time.Time{}},
+		{"SameDayWindow", Subscription{QuietStart: "12:00", QuietEnd: "14:00"},
+			time.Date(2025, 1, 2, 13, 30, 0, 0, time.UTC), true, time.Date(2025, 1, 2, 14, 0, 0, 0, time.UTC)},
+		{"Timezone", Subscription{Timezone: "Europe/Paris", QuietStart: "22:00", QuietEnd: "07:00"},
+			time.Date(2025, 1, 1, 22, 30, 0, 0, time.UTC), true, time.Date(2025, 1, 2, 7, 0, 0, 0, paris)},
+		{"TimezoneAwake", Subscription{Timezone: "Europe/Paris", QuietStart: "22:00", QuietEnd: "07:00"},
+			time.Date(2025, 1, 1, 6, 30, 0, 0, time.UTC), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, quiet := tt.sub.quietUntil(tt.at)
+			if quiet != tt.wantQuiet {
+				t.Fatalf("quiet = %v, want %v", quiet, tt.wantQuiet)
+			}
+			if quiet && !until.Equal(tt.wantUntil) {
+				t.Errorf("until = %v, want %v", until, tt.wantUntil)
+			}
+		})
+	}
+}
+
+func TestQuietHoursDelivery(t *testing.T) {
+	srv := newTestServer(t)
+
+	now := time.Now().UTC()
+	quiet := QuietHours{
+		Start: now.Add(-time.Hour).Format("15:04"),
+		End:   now.Add(time.Hour).Format("15:04"),
+		Mode:  quietModeDefer,
+	}
+	UpsertSubscription(srv.DB, "quiet", "https://push.example.com/defer", "key", "auth")
+	ok, err := SetSubscriptionPreferences(srv.DB, "https://push.example.com/defer", "auth", nil, nil, &quiet)
+	if err != nil || !ok {
+		t.Fatalf("SetSubscriptionPreferences: ok=%v err=%v", ok, err)
+	}
+	quiet.Mode = quietModeDrop
+	UpsertSubscription(srv.DB, "quiet", "https://push.example.com/drop", "key", "auth")
+	SetSubscriptionPreferences(srv.DB, "https://push.example.com/drop", "auth", nil, nil, &quiet)
+
+	// Wrong auth key is rejected.
+	ok, err = SetSubscriptionPreferences(srv.DB, "https://push.example.com/drop", "wrong", nil, nil, &quiet)
+	if err != nil || ok {
+		t.Errorf("expected wrong auth to match nothing, got ok=%v err=%v", ok, err)
+	}
+
+	result := srv.SendNotifications(NotifyRequest{Topic: "quiet", Title: "Late news"})
+	if result.Deferred != 1 || result.Dropped != 1 || result.Sent+result.Failed != 0 {
+		t.Fatalf("expected 1 deferred and 1 dropped, got %+v", result)
+	}
+
+	// Nothing is due before the window ends.
+	due, err := TakeDueDeferred(srv.DB, now)
+	if err != nil {
+		t.Fatalf("TakeDueDeferred: %v", err)
+	}
+	if len(due) != 0 {
+		t.Errorf("expected nothing due yet, got %d", len(due))
+	}
+
+	due, err = TakeDueDeferred(srv.DB, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("TakeDueDeferred: %v", err)
+	}
+	if len(due) != 1 || due[0].Request.Title != "Late news" || due[0].Subscription.Endpoint != "https://push.example.com/defer" {
+		t.Fatalf("expected the deferred notification to be due, got %+v", due)
+	}
+
+	// Taken entries are removed from the queue.
+	due, _ = TakeDueDeferred(srv.DB, now.Add(2*time.Hour))
+	if len(due) != 0 {
+		t.Errorf("expected the queue to be empty, got %d", len(due))
+	}
+}
+
+func TestParseFrequencyCap(t *testing.T) {
+	cap, err := parseFrequencyCap("5/1h")
+	if err != nil || cap.Max != 5 || cap.Window != time.Hour {
+		t.Errorf("parseFrequencyCap(5/1h) = %+v, %v", cap, err)
+	}
+	if cap, err := parseFrequencyCap(""); err != nil || cap.Max != 0 {
+		t.Errorf("expected empty cap to mean no cap, got %+v, %v", cap, err)
+	}
+	for _, bad := range []string{"5", "0/1h", "x/1h", "5/1w", "5/"} {
+		if _, err := parseFrequencyCap(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestFrequencyCaps(t *testing.T) {
+	srv := newTestServer(t)
+
+	// Topic cap: 2 per hour, already reached by one subscription.
+	if _, err := UpsertTopicConfig(srv.DB, TopicConfig{Name: "chatty", FrequencyCap: "2/1h"}); err != nil {
+		t.Fatalf("UpsertTopicConfig: %v", err)
+	}
+	full, _, _ := UpsertSubscription(srv.DB, "chatty", "https://push.example.com/full", "key", "auth")
+	UpsertSubscription(srv.DB, "chatty", "https://push.example.com/fresh", "key", "auth")
+	LogDelivery(srv.DB, full, "", 201, "")
+	LogDelivery(srv.DB, full, "", 201, "")
+	LogDelivery(srv.DB, full, "", 500, "failed deliveries do not count")
+
+	subs, _ := GetSubscriptionsByTopic(srv.DB, "chatty")
+	allowed, capped := srv.applyFrequencyCaps(subs, false)
+	if capped != 1 || len(allowed) != 1 || allowed[0].Endpoint != "https://push.example.com/fresh" {
+		t.Errorf("expected only the fresh subscription to pass the topic cap, got capped=%d allowed=%+v", capped, allowed)
+	}
+
+	// Global per-device cap counts deliveries across topics, including
+	// the ones made earlier in the same fan-out.
+	srv.FrequencyCap = FrequencyCap{Max: 1, Window: time.Hour}
+	UpsertSubscription(srv.DB, "a", "https://push.example.com/device", "key", "auth")
+	UpsertSubscription(srv.DB, "b", "https://push.example.com/device", "key", "auth")
+	subs = nil
+	for _, topic := range []string{"a", "b"} {
+		s, _ := GetSubscriptionsByTopic(srv.DB, topic)
+		subs = append(subs, s...)
+	}
+	allowed, capped = srv.applyFrequencyCaps(subs, false)
+	if capped != 1 || len(allowed) != 1 {
+		t.Errorf("expected one of two topics to be capped for the device, got capped=%d allowed=%d", capped, len(allowed))
+	}
+
+	// Concurrent sends reserve their deliveries before fan-out, so they
+	// cannot all pass on the same count of logged deliveries.
+	srv.FrequencyCap = FrequencyCap{}
+	push, received := newPushService(t)
+	UpsertTopicConfig(srv.DB, TopicConfig{Name: "burst", FrequencyCap: "1/1h"})
+	subscribeBrowser(t, srv.DB, "burst", push.URL+"/burst")
+	var wg sync.WaitGroup
+	var totalCapped atomic.Int64
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := srv.SendNotifications(NotifyRequest{Topic: "burst", Title: "Flood"})
+			totalCapped.Add(int64(result.Capped))
+		}()
+	}
+	wg.Wait()
+	if received.Load() != 1 || totalCapped.Load() != 9 {
+		t.Errorf("expected 1 push and 9 capped, got %d and %d", received.Load(), totalCapped.Load())
+	}
+	if len(srv.caps.subs) != 0 || len(srv.caps.endpoints) != 0 {
+		t.Errorf("expected reservations to be released, got %v %v", srv.caps.subs, srv.caps.endpoints)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	srv := newTestServer(t)
+	if _, err := UpsertTopicConfig(srv.DB, TopicConfig{Name: "builds", BatchWindow: "10m"}); err != nil {
+		t.Fatalf("UpsertTopicConfig: %v", err)
+	}
+
+	for _, title := range []string{"Build 1 passed", "Build 2 failed"} {
+		res := srv.SendNotifications(NotifyRequest{Topic: "builds", Title: title, Navigate: "https://ci.example.com/" + title})
+		if !res.Batched || res.Sent != 0 {
+			t.Fatalf("expected notification to be batched, got %+v", res)
+		}
+	}
+	if res := srv.SendNotifications(NotifyRequest{Topic: "builds", Title: "Outage", Urgency: "high"}); res.Batched {
+		t.Error("expected high urgency to bypass batching")
+	}
+
+	pending, err := PendingDigests(srv.DB)
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("expected one pending digest, got %v (err=%v)", pending, err)
+	}
+	events, err := TakeDigestEvents(srv.DB, "builds")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected 2 digest events, got %d (err=%v)", len(events), err)
+	}
+	if pending, _ := PendingDigests(srv.DB); len(pending) != 0 {
+		t.Errorf("expected digest events to be consumed, got %v", pending)
+	}
+
+	reqs := []NotifyRequest{events[0].Request, events[1].Request}
+	req, err := digestRequest("builds", reqs, nil)
+	if err != nil {
+		t.Fatalf("digestRequest: %v", err)
+	}
+	if req.Title != "2 new notifications" || req.Body != "Build 2 failed\nBuild 1 passed" {
+		t.Errorf("unexpected default summary: %q / %q", req.Title, req.Body)
+	}
+	if req.Tag != "digest:builds" || req.Navigate != "https://ci.example.com/Build 2 failed" {
+		t.Errorf("expected digest tag and latest navigate, got tag=%q navigate=%q", req.Tag, req.Navigate)
+	}
+
+	tmpl := &Template{Title: "{{.count}} builds", Body: "{{range .events}}{{.title}};{{end}}"}
+	req, err = digestRequest("builds", reqs, tmpl)
+	if err != nil {
+		t.Fatalf("digestRequest with template: %v", err)
+	}
+	if req.Title != "2 builds" || req.Body != "Build 1 passed;Build 2 failed;" {
+		t.Errorf("unexpected templated summary: %q / %q", req.Title, req.Body)
+	}
+
+	if req, _ := digestRequest("builds", reqs[:1], tmpl); req.Title != "Build 1 passed" {
+		t.Errorf("expected a single event to be sent unchanged, got %q", req.Title)
+	}
+}
+
+// newPushService starts a fake push service that accepts every message and
+// counts them.
+func newPushService(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var received atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &received
+}
+
+// subscribeBrowser subscribes endpoint to topic with valid encryption keys.
+func subscribeBrowser(t *testing.T, db *sql.DB, topic, endpoint string) string {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	id, _, err := UpsertSubscription(db, topic, endpoint,
+		base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(auth))
+	if err != nil {
+		t.Fatalf("UpsertSubscription: %v", err)
+	}
+	return id
+}
+
+func TestRetractNotification(t *testing.T) {
+	srv := newTestServer(t)
+	push, received := newPushService(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	subscribeBrowser(t, srv.DB, "news", push.URL+"/awake")
+	subscribeBrowser(t, srv.DB, "news", push.URL+"/asleep")
+	now := time.Now().UTC()
+	srv.DB.Exec(`UPDATE subscriptions SET quiet_start = ?, quiet_end = ?, quiet_mode = 'defer' WHERE endpoint = ?`,
+		now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04"), push.URL+"/asleep")
+
+	result := srv.SendNotifications(NotifyRequest{Topic: "news", Title: "Wrong headline", Tag: "headline"})
+	if result.ID == "" || result.Sent != 1 || result.Deferred != 1 {
+		t.Fatalf("expected 1 sent and 1 deferred with an ID, got %+v", result)
+	}
+
+	retract := func(id string) *http.Response {
+		req, _ := http.NewRequest("DELETE", ts.URL+"/notifications/"+id, nil)
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("DELETE /notifications/%s: %v", id, err)
+		}
+		return resp
+	}
+
+	resp := retract(result.ID)
+	var body RetractResult
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || body.Cancelled != 1 || body.Sent != 1 {
+		t.Fatalf("expected 1 cancelled and 1 retract push, got %d %+v", resp.StatusCode, body)
+	}
+	if got := received.Load(); got != 2 {
+		t.Errorf("expected the push service to receive the original and the retract, got %d", got)
+	}
+	if due, _ := TakeDueDeferred(srv.DB, now.Add(2*time.Hour)); len(due) != 0 {
+		t.Errorf("expected the deferred send to be cancelled, got %d due", len(due))
+	}
+
+	if resp := retract(result.ID); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 for a second retract, got %d", resp.StatusCode)
+	}
+	if resp := retract("unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown notification, got %d", resp.StatusCode)
+	}
+
+	// Untagged notifications keep their payload and cannot be closed.
+	untagged := srv.SendNotifications(NotifyRequest{Topic: "news", Title: "Plain"})
+	if n, err := GetNotification(srv.DB, untagged.ID); err != nil || n.Request.Tag != "" {
+		t.Fatalf("expected an untagged recorded notification, got %+v (err=%v)", n, err)
+	}
+	resp = retract(untagged.ID)
+	body = RetractResult{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || body.Cancelled != 1 || body.Unclosed != 1 || body.Sent != 0 || received.Load() != 3 {
+		t.Errorf("expected the untagged send cancelled without a retract push, got %d %+v", resp.StatusCode, body)
+	}
+}
+
+func TestUpdateNotification(t *testing.T) {
+	srv := newTestServer(t)
+	push, received := newPushService(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	subscribeBrowser(t, srv.DB, "builds", push.URL+"/early")
+	result := srv.SendNotifications(NotifyRequest{Topic: "builds", Title: "Build #7", Body: "running", Tag: "build-7", Renotify: true})
+	if result.Sent != 1 {
+		t.Fatalf("expected 1 sent, got %+v", result)
+	}
+	// Joined after the original: must not receive the update.
+	subscribeBrowser(t, srv.DB, "builds", push.URL+"/late")
+
+	patch := func(body string) (*http.Response, UpdateResult) {
+		req, _ := http.NewRequest("PATCH", ts.URL+"/notifications/"+result.ID, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("PATCH /notifications/%s: %v", result.ID, err)
+		}
+		defer resp.Body.Close()
+		var update UpdateResult
+		json.NewDecoder(resp.Body).Decode(&update)
+		return resp, update
+	}
+
+	for _, field := range []string{`"tag":"other"`, `"topic":"other"`, `"dry_run":true`, `"subscription_ids":["x"]`,
+		`"Tag":"other"`, `"TOPIC":"other"`, `"Dry_Run":true`, `"Subscription_IDs":["x"]`} {
+		if resp, _ := patch(`{"body":"passed",` + field + `}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected 400 for {%s}, got %d", field, resp.StatusCode)
+		}
+	}
+
+	resp, body := patch(`{"body":"passed"}`)
+	if resp.StatusCode != http.StatusOK || body.Sent != 1 {
+		t.Fatalf("expected the update to reach only the original recipient, got %d %+v", resp.StatusCode, body)
+	}
+	if got := received.Load(); got != 2 {
+		t.Errorf("expected 2 pushes in total, got %d", got)
+	}
+
+	n, _ := GetNotification(srv.DB, result.ID)
+	if n.Request.Title != "Build #7" || n.Request.Body != "passed" || n.Request.Tag != "build-7" || n.Request.Renotify {
+		t.Errorf("expected updated body with the original tag and renotify off, got %+v", n.Request)
+	}
+
+	// A template in the update renders the title and body again.
+	UpsertTemplate(srv.DB, Template{Name: "build", Title: "Deploy #{{.n}}", Body: "{{.status}}"})
+	if resp, _ := patch(`{"Template":"build","Vars":{"n":7,"status":"failed"}}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for a template update, got %d", resp.StatusCode)
+	}
+	n, _ = GetNotification(srv.DB, result.ID)
+	if n.Request.Title != "Deploy #7" || n.Request.Body != "failed" || n.Request.Tag != "build-7" {
+		t.Errorf("expected the template to be rendered again, got %+v", n.Request)
+	}
+}
+
+func TestPreviewNotification(t *testing.T) {
+	srv := newTestServer(t)
+	push, received := newPushService(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	subscribeBrowser(t, srv.DB, "launch", push.URL+"/en")
+	subscribeBrowser(t, srv.DB, "launch", push.URL+"/fr")
+	SetSubscriptionLocale(srv.DB, push.URL+"/fr", "fr-CA")
+	subscribeBrowser(t, srv.DB, "launch", push.URL+"/asleep")
+	now := time.Now().UTC()
+	srv.DB.Exec(`UPDATE subscriptions SET quiet_start = ?, quiet_end = ?, quiet_mode = 'drop' WHERE endpoint = ?`,
+		now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04"), push.URL+"/asleep")
+
+	post := func(path, body string) PreviewResult {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s: expected 200, got %d", path, resp.StatusCode)
+		}
+		var result PreviewResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+
+	result := post("/notify/preview", `{"topic":"launch","title":"We're live","localizations":{"fr":{"title":"C'est parti"}}}`)
+	host := strings.TrimPrefix(push.URL, "http://")
+	if !result.DryRun || result.Recipients != 2 || result.Dropped != 1 || result.ByPushService[host] != 2 {
+		t.Errorf("unexpected audience: %+v", result)
+	}
+	if len(result.Payloads) != 2 || result.Payloads[1].Locale != "fr" || result.Payloads[1].Recipients != 1 {
+		t.Fatalf("expected default and fr payloads with 1 recipient each, got %+v", result.Payloads)
+	}
+	if !strings.Contains(string(result.Payloads[1].Content), "C'est parti") || result.Payloads[1].Size.Payload != len(result.Payloads[1].Content) {
+		t.Errorf("expected rendered fr payload with its size, got %s (%+v)", result.Payloads[1].Content, result.Payloads[1].Size)
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL+"/topics/launch/notify", strings.NewReader(`{"title":"We're live","dry_run":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /topics/launch/notify: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a public dry run, got %d", resp.StatusCode)
+	}
+
+	result = post("/topics/launch/notify", `{"title":"We're live","dry_run":true}`)
+	if !result.DryRun || result.Recipients != 2 {
+		t.Errorf("expected dry run on the topic endpoint, got %+v", result)
+	}
+	if got := received.Load(); got != 0 {
+		t.Errorf("expected no pushes during dry runs, got %d", got)
+	}
+}
+
+func TestNotifySubscriptionIDs(t *testing.T) {
+	srv := newTestServer(t)
+	push, received := newPushService(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	target := subscribeBrowser(t, srv.DB, "support", push.URL+"/target")
+	subscribeBrowser(t, srv.DB, "support", push.URL+"/other")
+
+	post := func(path, body string) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		return resp
+	}
+
+	resp := post("/notify", `{"title":"Test","subscription_ids":["`+target+`","missing","missing"]}`)
+	defer resp.Body.Close()
+	var result NotifyResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.Sent != 1 || len(result.UnknownIDs) != 1 || result.UnknownIDs[0] != "missing" {
+		t.Errorf("expected 1 sent and the unknown ID reported once, got %d %+v", resp.StatusCode, result)
+	}
+	if got := received.Load(); got != 1 {
+		t.Errorf("expected only the targeted device to be notified, got %d pushes", got)
+	}
+
+	for path, body := range map[string]string{
+		"/notify":                `{"title":"Test","topic":"support","subscription_ids":["` + target + `"]}`,
+		"/topics/support/notify": `{"title":"Test","subscription_ids":["` + target + `"]}`,
+	} {
+		resp := post(path, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s: expected 400, got %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestVerboseResults(t *testing.T) {
+	srv := newTestServer(t)
+	push := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			http.Error(w, "subscription expired", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer push.Close()
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	subscribeBrowser(t, srv.DB, "verbose", push.URL+"/ok")
+	gone := subscribeBrowser(t, srv.DB, "verbose", push.URL+"/gone")
+
+	notify := func(path string, admin bool) NotifyResult {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(`{"topic":"verbose","title":"Hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if admin {
+			req.Header.Set("Authorization", "Bearer test-admin-key")
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST /notify: %v", err)
+		}
+		defer resp.Body.Close()
+		var result NotifyResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result
+	}
+
+	result := notify("/notify?verbose=true", true)
+	if len(result.Deliveries) != 2 {
+		t.Fatalf("expected 2 deliveries, got %+v", result.Deliveries)
+	}
+	for _, d := range result.Deliveries {
+		if d.PushService != strings.TrimPrefix(push.URL, "http://") {
+			t.Errorf("unexpected push service %q", d.PushService)
+		}
+		if d.SubscriptionID == gone {
+			if d.StatusCode != http.StatusGone || !d.Removed || d.Error != "subscription expired" {
+				t.Errorf("expected removed 410 with error text, got %+v", d)
+			}
+		} else if d.StatusCode != http.StatusCreated || d.Removed || d.Error != "" {
+			t.Errorf("expected successful delivery, got %+v", d)
+		}
+	}
+
+	if result := notify("/notify", true); result.Sent != 1 || result.Deliveries != nil {
+		t.Errorf("expected aggregate counts only without verbose, got %+v", result)
+	}
+
+	// The public topic endpoint only reports deliveries to the admin.
+	if result := notify("/topics/verbose/notify?verbose=true", false); result.Sent != 1 || result.Deliveries != nil {
+		t.Errorf("expected no deliveries without the admin key, got %+v", result)
+	}
+	if result := notify("/topics/verbose/notify?verbose=true", true); len(result.Deliveries) != 1 {
+		t.Errorf("expected deliveries with the admin key, got %+v", result)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	defer func(delays []time.Duration) { webhookRetryDelays = delays }(webhookRetryDelays)
+	webhookRetryDelays = []time.Duration{time.Millisecond}
+
+	// The receiver fails the first attempt, then accepts.
+	var attempts atomic.Int32
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	admin := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+
+	resp := admin("POST", "/webhooks", `{"url":"`+receiver.URL+`","events":["subscription.nope"]}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown event, got %d", resp.StatusCode)
+	}
+
+	resp = admin("POST", "/webhooks", `{"url":"`+receiver.URL+`","events":["subscription.created"],"secret":"s3cret"}`)
+	var wh Webhook
+	json.NewDecoder(resp.Body).Decode(&wh)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || wh.ID == "" {
+		t.Fatalf("expected 201 with a webhook ID, got %d %+v", resp.StatusCode, wh)
+	}
+
+	payload := `{"topic":"alerts","subscription":{"endpoint":"https://push.example.com/hooks","keys":{"p256dh":"dGVzdA","auth":"dGVzdA"}}}`
+	resp, _ = ts.Client().Post(ts.URL+"/subscriptions", "application/json", strings.NewReader(payload))
+	resp.Body.Close()
+
+	var r *http.Request
+	var body []byte
+	select {
+	case r = <-received:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the webhook")
+	}
+	if r.Header.Get("X-Webhook-Event") != eventSubscriptionCreated {
+		t.Errorf("expected %s event, got %q", eventSubscriptionCreated, r.Header.Get("X-Webhook-Event"))
+	}
+	if got := r.Header.Get("X-Webhook-Signature"); got != signWebhookPayload("s3cret", body) {
+		t.Errorf("signature mismatch: %q", got)
+	}
+	var ev struct {
+		Type string            `json:"type"`
+		Data SubscriptionEvent `json:"data"`
+	}
+	json.Unmarshal(body, &ev)
+	if ev.Type != eventSubscriptionCreated || ev.Data.Topic != "alerts" || ev.Data.Endpoint != "https://push.example.com/hooks" {
+		t.Errorf("unexpected event payload: %s", body)
+	}
+
+	srv.WG.Wait()
+	deliveries, err := ListWebhookDeliveries(srv.DB, wh.ID, 10)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("expected 2 logged attempts, got %+v (err=%v)", deliveries, err)
+	}
+	if deliveries[0].Attempt != 2 || deliveries[0].StatusCode != http.StatusOK || deliveries[1].StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a failed attempt then a successful retry, got %+v", deliveries)
+	}
+
+	// A deleted webhook no longer receives events.
+	resp = admin("DELETE", "/webhooks/"+wh.ID, "")
+	resp.Body.Close()
+	payload = `{"topic":"alerts","subscription":{"endpoint":"https://push.example.com/after","keys":{"p256dh":"dGVzdA","auth":"dGVzdA"}}}`
+	resp, _ = ts.Client().Post(ts.URL+"/subscriptions", "application/json", strings.NewReader(payload))
+	resp.Body.Close()
+	srv.WG.Wait()
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("expected no delivery after the webhook was deleted, got %d attempts", got)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	defer srv.CloseEventStreams()
+
+	var n int
+	subscribe := func(topic string) {
+		n++
+		payload := `{"topic":"` + topic + `","subscription":{"endpoint":"https://push.example.com/` + strconv.Itoa(n) + `","keys":{"p256dh":"dGVzdA","auth":"dGVzdA"}}}`
+		resp, err := ts.Client().Post(ts.URL+"/subscriptions", "application/json", strings.NewReader(payload))
+		if err != nil {
+			t.Fatalf("POST /subscriptions: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// open connects to the stream and returns a function reading its next event.
+	open := func(query, lastEventID string) func() (id, typ string, ev Event) {
+		req, _ := http.NewRequest("GET", ts.URL+"/events"+query, nil)
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("GET /events: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		lines := make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		return func() (id, typ string, ev Event) {
+			for {
+				select {
+				case line, ok := <-lines:
+					if !ok {
+						t.Fatal("stream ended")
+					}
+					switch {
+					case strings.HasPrefix(line, "id: "):
+						id = strings.TrimPrefix(line, "id: ")
+					case strings.HasPrefix(line, "event: "):
+						typ = strings.TrimPrefix(line, "event: ")
+					case strings.HasPrefix(line, "data: "):
+						json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev)
+					case line == "" && id != "":
+						return id, typ, ev
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for an event")
+				}
+			}
+		}
+	}
+
+	resp, _ := ts.Client().Get(ts.URL + "/events")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without admin key, got %d", resp.StatusCode)
+	}
+
+	subscribe("alpha") // event 1
+	subscribe("beta")  // event 2
+
+	// Resuming from the start replays the buffer, filtered by topic.
+	nextAlpha := open("?topic=alpha", "0")
+	id, typ, ev := nextAlpha()
+	if id != "1" || typ != eventSubscriptionCreated || ev.Data.(map[string]any)["topic"] != "alpha" {
+		t.Errorf("expected replayed alpha subscription event 1, got id=%s type=%s %+v", id, typ, ev)
+	}
+
+	// Resuming after event 1 replays event 2 only.
+	next := open("", "1")
+	if id, _, ev := next(); id != "2" || ev.Data.(map[string]any)["topic"] != "beta" {
+		t.Errorf("expected replayed beta subscription event 2, got id=%s %+v", id, ev)
+	}
+
+	// Live events reach both streams; the filtered one skips other topics.
+	subscribe("beta")
+	subscribe("alpha")
+	if id, _, _ := next(); id != "3" {
+		t.Errorf("expected live event 3, got %s", id)
+	}
+	if id, _, _ := nextAlpha(); id != "4" {
+		t.Errorf("expected alpha stream to skip to event 4, got %s", id)
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/admin")
+	if err != nil {
+		t.Fatalf("GET /admin: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "go-notify-server admin") {
+		t.Errorf("expected the dashboard page, got %d", resp.StatusCode)
+	}
+
+	a, _, _ := UpsertSubscription(srv.DB, "alerts", "https://push.example.com/a", "k", "a")
+	UpsertSubscription(srv.DB, "alerts", "https://push.example.com/b", "k", "a")
+	UpsertSubscription(srv.DB, "news", "https://push.example.com/c", "k", "a")
+	if _, err := UpsertTopicConfig(srv.DB, TopicConfig{Name: "empty"}); err != nil {
+		t.Fatalf("UpsertTopicConfig: %v", err)
+	}
+	LogDelivery(srv.DB, a, "n1", http.StatusCreated, "")
+	LogDelivery(srv.DB, a, "n2", http.StatusTooManyRequests, "slow down")
+	LogDelivery(srv.DB, "gone", "n2", http.StatusGone, "")
+
+	req, _ := http.NewRequest("GET", ts.URL+"/stats", nil)
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	var stats Stats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+
+	want := []TopicCount{{"alerts", 2, false}, {"empty", 0, true}, {"news", 1, false}}
+	if stats.Subscriptions != 3 || len(stats.Topics) != 3 || stats.Topics[0] != want[0] || stats.Topics[1] != want[1] || stats.Topics[2] != want[2] {
+		t.Errorf("unexpected topic counts: %d %+v", stats.Subscriptions, stats.Topics)
+	}
+	if d := stats.Deliveries; d.Attempts != 3 || d.Succeeded != 1 || d.Failed != 2 || d.Stale != 1 {
+		t.Errorf("unexpected delivery stats: %+v", d)
+	}
+	if f := stats.RecentFailures; len(f) != 2 || f[0].StatusCode != http.StatusGone || f[1].Topic != "alerts" || f[1].Error != "slow down" {
+		t.Errorf("unexpected recent failures: %+v", f)
+	}
+}
+
+func TestTopicPage(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := ts.Client().Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := get("/t/releases"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unconfigured topic, got %d", code)
+	}
+	UpsertTopicConfig(srv.DB, TopicConfig{Name: "releases", Title: "Releases"})
+	if code, _ := get("/t/releases"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a topic without page, got %d", code)
+	}
+
+	UpsertTopicConfig(srv.DB, TopicConfig{Name: "releases", Title: "Releases <beta>", Description: "New versions", Icon: "/icon.png", Page: true})
+	code, page := get("/t/releases")
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for _, want := range []string{"<h1>Releases &lt;beta&gt;</h1>", "New versions", `src="/icon.png"`, `src="../client.js"`, `const topic = "releases";`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected page to contain %q", want)
+		}
+	}
+}
+
+func TestNtfyPublish(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	push, received := newPushService(t)
+	subscribeBrowser(t, srv.DB, "alerts", push.URL+"/alerts")
+
+	publish := func(method, path, body string, headers map[string]string) (int, ntfyMessage, NotifyRequest) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded") // as sent by curl -d
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var m ntfyMessage
+		json.NewDecoder(resp.Body).Decode(&m)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, m, NotifyRequest{}
+		}
+		n, err := GetNotification(srv.DB, m.ID)
+		if err != nil {
+			t.Fatalf("GetNotification(%q): %v", m.ID, err)
+		}
+		return resp.StatusCode, m, n.Request
+	}
+
+	code, m, req := publish("POST", "/alerts", "Disk is 95% full\n", map[string]string{
+		"Title":    "=?UTF-8?B?U2VydmVyIMOpdGF0?=", // "Server état"
+		"Priority": "urgent",
+		"Tags":     "warning, disk",
+		"X-Click":  "https://status.example.com/disk",
+	})
+	if code != http.StatusOK || m.Event != "message" || m.Topic != "alerts" || m.Priority != 5 || len(m.Tags) != 2 {
+		t.Fatalf("unexpected publish response %d %+v", code, m)
+	}
+	if req.Title != "⚠️ Server état" || req.Body != "Disk is 95% full" || req.Urgency != "high" || !req.RequireInteraction {
+		t.Errorf("unexpected notification %+v", req)
+	}
+	if req.Navigate != "https://status.example.com/disk" || req.Data["url"] != "https://status.example.com/disk" {
+		t.Errorf("expected the click URL as navigate and data.url, got %q %v", req.Navigate, req.Data)
+	}
+	if received.Load() != 1 {
+		t.Errorf("expected 1 push, got %d", received.Load())
+	}
+
+	UpsertTopicConfig(srv.DB, TopicConfig{Name: "alerts", Title: "Alerts"})
+	code, _, req = publish("PUT", "/alerts?priority=low", "", nil)
+	if code != http.StatusOK || req.Title != "Alerts" || req.Body != "triggered" || req.Urgency != "low" || req.Silent == nil || !*req.Silent {
+		t.Errorf("expected a silent low urgency notification titled from the topic config, got %d %+v", code, req)
+	}
+
+	code, m, req = publish("POST", "/", `{"topic":"alerts","message":"Backup done","tags":["white_check_mark"],"actions":[{"action":"view","label":"Logs","url":"https://backup.example.com/logs"},{"action":"http","label":"Retry","url":"https://backup.example.com/retry"}]}`, nil)
+	if code != http.StatusOK || m.Priority != 3 || req.Title != "✅ Alerts" || req.Urgency != "normal" {
+		t.Errorf("unexpected JSON publish result %d %+v %+v", code, m, req)
+	}
+	if len(req.Actions) != 1 || req.Actions[0].Title != "Logs" || req.Actions[0].Navigate != "https://backup.example.com/logs" {
+		t.Errorf("expected only the view action, got %+v", req.Actions)
+	}
+
+	if code, _, _ := publish("POST", "/alerts", "x", map[string]string{"Priority": "6"}); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid priority, got %d", code)
+	}
+	if code, _, _ := publish("POST", "/", `{"message":"no topic"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without topic, got %d", code)
+	}
+
+	// Names of the server's own endpoints cannot be topics.
+	if code, _, _ := publish("POST", "/templates", "x", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a reserved topic, got %d", code)
+	}
+	if code, _, _ := publish("POST", "/", `{"topic":"hooks","message":"x"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a reserved JSON topic, got %d", code)
+	}
+	resp, _ := ts.Client().Post(ts.URL+"/subscriptions", "application/json",
+		strings.NewReader(`{"topic":"notify","subscription":{"endpoint":"https://push.example.com/x","keys":{"p256dh":"dGVzdA","auth":"dGVzdA"}}}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 subscribing to a reserved topic, got %d", resp.StatusCode)
+	}
+	r, _ := http.NewRequest("PUT", ts.URL+"/topics/webhooks/config", strings.NewReader(`{"title":"Webhooks"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, _ = ts.Client().Do(r)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 configuring a reserved topic, got %d", resp.StatusCode)
+	}
+}
+
+func TestGotifyMessage(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	push, received := newPushService(t)
+	subscribeBrowser(t, srv.DB, "monitoring", push.URL+"/monitoring")
+
+	req, _ := http.NewRequest("POST", ts.URL+"/gotify/apps", strings.NewReader(`{"name":"Zabbix","topic":"monitoring"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /gotify/apps: %v", err)
+	}
+	var app GotifyApp
+	json.NewDecoder(resp.Body).Decode(&app)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || app.Token == "" || app.ID == 0 {
+		t.Fatalf("expected 201 with a token, got %d %+v", resp.StatusCode, app)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/gotify/apps", strings.NewReader(`{"name":"Nagios"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, _ = ts.Client().Do(req)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an app without topic, got %d", resp.StatusCode)
+	}
+
+	resp, _ = ts.Client().PostForm(ts.URL+"/message?token=nope", url.Values{"message": {"hi"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", resp.StatusCode)
+	}
+
+	// Form publish (curl -F), defaulting the title to the app name.
+	resp, err = ts.Client().PostForm(ts.URL+"/message?token="+app.Token, url.Values{"message": {"CPU at 99%"}, "priority": {"9"}})
+	if err != nil {
+		t.Fatalf("POST /message: %v", err)
+	}
+	var m gotifyMessage
+	json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || m.ID == 0 || m.AppID != app.ID || m.Title != "Zabbix" || *m.Priority != 9 {
+		t.Fatalf("unexpected response %d %+v", resp.StatusCode, m)
+	}
+	if received.Load() != 1 {
+		t.Errorf("expected 1 push, got %d", received.Load())
+	}
+
+	// JSON publish with the key in a header and a click URL in the extras.
+	req, _ = http.NewRequest("POST", ts.URL+"/message", strings.NewReader(`{"title":"Disk","message":"Disk full","priority":2,"extras":{"client::notification":{"click":{"url":"https://zabbix.example.com/events/1"}}}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", app.Token)
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /message: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var id string
+	srv.DB.QueryRow(`SELECT id FROM notifications WHERE rowid = ?`, m.ID).Scan(&id)
+	n, err := GetNotification(srv.DB, id)
+	if err != nil {
+		t.Fatalf("GetNotification: %v", err)
+	}
+	if n.Topic != "monitoring" || n.Request.Title != "Disk" || n.Request.Urgency != "low" || n.Request.Silent == nil || !*n.Request.Silent {
+		t.Errorf("unexpected notification %+v", n.Request)
+	}
+	if n.Request.Navigate != "https://zabbix.example.com/events/1" || n.Request.Data["url"] != "https://zabbix.example.com/events/1" {
+		t.Errorf("expected the click URL, got %q %v", n.Request.Navigate, n.Request.Data)
+	}
+
+	// A message that was sent but could not be recorded still succeeds.
+	srv.DB.Exec(`DROP TABLE notifications`)
+	resp, err = ts.Client().PostForm(ts.URL+"/message?token="+app.Token, url.Values{"message": {"Unrecorded"}})
+	if err != nil {
+		t.Fatalf("POST /message: %v", err)
+	}
+	m = gotifyMessage{}
+	json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || m.ID != 0 || received.Load() != 3 {
+		t.Errorf("expected 200 with ID 0 after the push, got %d %+v (%d pushes)", resp.StatusCode, m, received.Load())
+	}
+}
+
+func TestAlertmanager(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	push, received := newPushService(t)
+	subscribeBrowser(t, srv.DB, "oncall", push.URL+"/oncall")
+
+	post := func(body string) NotifyResult {
+		t.Helper()
+		resp, err := ts.Client().Post(ts.URL+"/integrations/alertmanager/oncall", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /integrations/alertmanager/oncall: %v", err)
+		}
+		defer resp.Body.Close()
+		var result NotifyResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		return result
+	}
+
+	resp, _ := ts.Client().Post(ts.URL+"/integrations/alertmanager/oncall", "application/json", strings.NewReader(`{"status":"firing"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without alerts, got %d", resp.StatusCode)
+	}
+
+	firing := post(`{"version":"4","groupKey":"{}:{alertname=\"HighLatency\"}","status":"firing","groupLabels":{"alertname":"HighLatency"},"externalURL":"https://alertmanager.example.com","alerts":[` +
+		`{"status":"firing","labels":{"alertname":"HighLatency","severity":"warning","instance":"api-1"},"annotations":{"summary":"p99 above 2s"},"generatorURL":"https://prometheus.example.com/graph"},` +
+		`{"status":"firing","labels":{"alertname":"HighLatency","severity":"critical","instance":"api-2"},"annotations":{"summary":"p99 above 5s"}}]}`)
+	n, err := GetNotification(srv.DB, firing.ID)
+	if err != nil {
+		t.Fatalf("GetNotification: %v", err)
+	}
+	tag := alertmanagerTag(`{}:{alertname="HighLatency"}`)
+	if n.Topic != "oncall" || n.Request.Title != "[FIRING:2] HighLatency" || n.Request.Urgency != "high" || n.Request.Tag != tag || !n.Request.Renotify {
+		t.Errorf("unexpected firing notification %+v", n.Request)
+	}
+	if n.Request.Body != "🔥 p99 above 2s (api-1)\n🔥 p99 above 5s (api-2)" {
+		t.Errorf("unexpected body %q", n.Request.Body)
+	}
+	if n.Request.Navigate != "https://prometheus.example.com/graph" {
+		t.Errorf("expected the generator URL, got %q", n.Request.Navigate)
+	}
+
+	// The resolved group replaces the firing notification, silently.
+	resolved := post(`{"version":"4","groupKey":"{}:{alertname=\"HighLatency\"}","status":"resolved","groupLabels":{"alertname":"HighLatency"},"alerts":[` +
+		`{"status":"resolved","labels":{"alertname":"HighLatency","severity":"critical","instance":"api-2"},"annotations":{"summary":"p99 above 5s"}}]}`)
+	n, err = GetNotification(srv.DB, resolved.ID)
+	if err != nil {
+		t.Fatalf("GetNotification: %v", err)
+	}
+	if n.Request.Title != "[RESOLVED] HighLatency" || n.Request.Tag != tag || n.Request.Silent == nil || !*n.Request.Silent {
+		t.Errorf("unexpected resolved notification %+v", n.Request)
+	}
+	if received.Load() != 2 {
+		t.Errorf("expected 2 pushes, got %d", received.Load())
+	}
+}
+
+func TestRepoWebhooks(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	push, received := newPushService(t)
+	subscribeBrowser(t, srv.DB, "dev", push.URL+"/dev")
+	if _, err := UpsertTopicConfig(srv.DB, TopicConfig{Name: "dev", GitHubSecret: "gh-s3cret", GitLabToken: "gl-s3cret", RepoEvents: []string{"review", "ci"}}); err != nil {
+		t.Fatalf("UpsertTopicConfig: %v", err)
+	}
+
+	post := func(path, body string, headers map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		return resp
+	}
+	github := func(event, body, secret string) *http.Response {
+		return post("/integrations/github/dev", body, map[string]string{"X-GitHub-Event": event, "X-Hub-Signature-256": signWebhookPayload(secret, []byte(body))})
+	}
+	notification := func(resp *http.Response) Notification {
+		t.Helper()
+		defer resp.Body.Close()
+		var result NotifyResult
+		json.NewDecoder(resp.Body).Decode(&result)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		n, err := GetNotification(srv.DB, result.ID)
+		if err != nil {
+			t.Fatalf("GetNotification: %v", err)
+		}
+		return n
+	}
+
+	review := `{"action":"submitted","repository":{"full_name":"acme/api"},"pull_request":{"number":12,"title":"Fix login redirect","html_url":"https://github.com/acme/api/pull/12"},` +
+		`"review":{"state":"approved","body":"LGTM","html_url":"https://github.com/acme/api/pull/12#pullrequestreview-1","user":{"login":"alice"}}}`
+	resp := github("pull_request_review", review, "wrong")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad signature, got %d", resp.StatusCode)
+	}
+	resp = post("/integrations/github/other", review, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a topic without secret, got %d", resp.StatusCode)
+	}
+
+	n := notification(github("pull_request_review", review, "gh-s3cret"))
+	if n.Request.Title != "[acme/api] alice approved #12" || n.Request.Body != "Fix login redirect\n\nLGTM" || n.Request.Tag != "github:acme/api#12" {
+		t.Errorf("unexpected review notification %+v", n.Request)
+	}
+	if n.Request.Data["url"] != "https://github.com/acme/api/pull/12#pullrequestreview-1" || n.Request.Data["event"] != "review" {
+		t.Errorf("unexpected data %v", n.Request.Data)
+	}
+
+	n = notification(github("workflow_run", `{"action":"completed","repository":{"full_name":"acme/api"},"workflow_run":{"name":"CI","display_title":"Bump deps","head_branch":"main","conclusion":"failure","html_url":"https://github.com/acme/api/actions/runs/7"}}`, "gh-s3cret"))
+	if n.Request.Title != "[acme/api] CI failed on main" || n.Request.Navigate != "https://github.com/acme/api/actions/runs/7" {
+		t.Errorf("unexpected CI notification %+v", n.Request)
+	}
+
+	// Pings, successful runs and events left out of repo_events are not forwarded.
+	for event, body := range map[string]string{
+		"ping":         `{"zen":"Keep it logically awesome."}`,
+		"workflow_run": `{"action":"completed","repository":{"full_name":"acme/api"},"workflow_run":{"name":"CI","conclusion":"success"}}`,
+		"release":      `{"action":"published","repository":{"full_name":"acme/api"},"release":{"tag_name":"v1.0.0","html_url":"https://github.com/acme/api/releases/v1.0.0"}}`,
+	} {
+		resp := github(event, body, "gh-s3cret")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: expected 204, got %d", event, resp.StatusCode)
+		}
+	}
+
+	pipeline := `{"object_kind":"pipeline","project":{"path_with_namespace":"acme/web","web_url":"https://gitlab.com/acme/web"},"object_attributes":{"id":99,"status":"failed","ref":"main"},"commit":{"title":"Add cache"}}`
+	resp = post("/integrations/gitlab/dev", pipeline, map[string]string{"X-Gitlab-Token": "wrong"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad token, got %d", resp.StatusCode)
+	}
+	n = notification(post("/integrations/gitlab/dev", pipeline, map[string]string{"X-Gitlab-Token": "gl-s3cret"}))
+	if n.Request.Title != "[acme/web] Pipeline failed on main" || n.Request.Body != "Add cache" || n.Request.Data["url"] != "https://gitlab.com/acme/web/-/pipelines/99" {
+		t.Errorf("unexpected pipeline notification %+v", n.Request)
+	}
+
+	// Updating other settings keeps the secrets, which are never returned.
+	req, _ := http.NewRequest("PUT", ts.URL+"/topics/dev/config", strings.NewReader(`{"title":"Dev"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	if resp, err := ts.Client().Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT /topics/dev/config: %v %v", err, resp)
+	}
+	req, _ = http.NewRequest("GET", ts.URL+"/topics/dev/config", nil)
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /topics/dev/config: %v", err)
+	}
+	var cfg TopicConfig
+	json.NewDecoder(resp.Body).Decode(&cfg)
+	resp.Body.Close()
+	if cfg.Title != "Dev" || cfg.GitHubSecret != "" || cfg.GitLabToken != "" || len(cfg.RepoEvents) != 2 {
+		t.Errorf("expected the title updated, secrets hidden and events kept, got %+v", cfg)
+	}
+	n = notification(github("pull_request_review", review, "gh-s3cret"))
+	if n.Request.Tag != "github:acme/api#12" {
+		t.Errorf("expected the kept secret to verify, got %+v", n.Request)
+	}
+
+	if received.Load() != 4 {
+		t.Errorf("expected 4 pushes, got %d", received.Load())
+	}
+}
+
+func TestInboundHooks(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.NewRouter("*"))
+	defer ts.Close()
+	push, received := newPushService(t)
+	subscribeBrowser(t, srv.DB, "deploys", push.URL+"/deploys")
+
+	do := func(method, path, body string, headers map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+	admin := map[string]string{"Authorization": "Bearer test-admin-key"}
+
+	resp := do("PUT", "/hooks/deploy", `{"mapping":{"bogus":"$.x"}}`, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown field, got %d", resp.StatusCode)
+	}
+	resp = do("PUT", "/hooks/deploy", `{"mapping":{"title":"$.app","dry_run":true}}`, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a dry_run mapping, got %d", resp.StatusCode)
+	}
+	resp = do("PUT", "/hooks/deploy", `{"mapping":{"title":"$.app["}}`, admin)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid JSONPath, got %d", resp.StatusCode)
+	}
+
+	mapping := `{"mapping":{"topic":"deploys","title":"Deployed {{.app}}","body":"$.build.commits[0]['message']","navigate":"$.build.url",` +
+		`"urgency":"$.urgency","data":{"version":"$.build.version","env":"{{.env}}"}}}`
+	resp = do("PUT", "/hooks/deploy", mapping, admin)
+	var hook Hook
+	json.NewDecoder(resp.Body).Decode(&hook)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || hook.Secret == "" {
+		t.Fatalf("expected 201 with a secret, got %d %+v", resp.StatusCode, hook)
+	}
+
+	// Replacing the mapping without a secret keeps it; listing hides it.
+	resp = do("PUT", "/hooks/deploy", mapping, admin)
+	var updated Hook
+	json.NewDecoder(resp.Body).Decode(&updated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || updated.Secret != hook.Secret {
+		t.Errorf("expected 200 keeping the secret, got %d %q", resp.StatusCode, updated.Secret)
+	}
+	resp = do("GET", "/hooks", "", admin)
+	var list struct{ Hooks []Hook }
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Hooks) != 1 || list.Hooks[0].Secret != "" {
+		t.Errorf("expected 1 hook without secret, got %+v", list.Hooks)
+	}
+
+	payload := `{"app":"api","env":"prod","build":{"version":42,"url":"https://ci.example.com/builds/42","commits":[{"message":"Fix cache"}]}}`
+	resp = do("POST", "/hooks/deploy/test", payload, admin)
+	var tested struct {
+		Request NotifyRequest `json:"request"`
+		Error   string        `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&tested)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || tested.Error != "" {
+		t.Fatalf("expected a valid mapping, got %d %q", resp.StatusCode, tested.Error)
+	}
+	if tested.Request.Title != "Deployed api" || tested.Request.Body != "Fix cache" || tested.Request.Navigate != "https://ci.example.com/builds/42" || tested.Request.Urgency != "" {
+		t.Errorf("unexpected mapped request %+v", tested.Request)
+	}
+	if tested.Request.Data["version"] != float64(42) || tested.Request.Data["env"] != "prod" {
+		t.Errorf("unexpected mapped data %v", tested.Request.Data)
+	}
+	if received.Load() != 0 {
+		t.Errorf("expected the test to send nothing, got %d pushes", received.Load())
+	}
+
+	resp = do("POST", "/hooks/deploy/test", `{"env":"prod"}`, admin)
+	json.NewDecoder(resp.Body).Decode(&tested)
+	resp.Body.Close()
+	if tested.Error == "" {
+		t.Errorf("expected an error for a payload missing app")
+	}
+
+	resp = do("POST", "/hooks/deploy", payload, map[string]string{"X-Hook-Secret": "wrong"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad secret, got %d", resp.StatusCode)
+	}
+	resp = do("POST", "/hooks/deploy?secret="+hook.Secret, payload, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 with the secret, got %d", resp.StatusCode)
+	}
+	resp = do("POST", "/hooks/deploy", payload, map[string]string{"X-Webhook-Signature": signWebhookPayload(hook.Secret, []byte(payload))})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 with a signature, got %d", resp.StatusCode)
+	}
+	if received.Load() != 2 {
+		t.Errorf("expected 2 pushes, got %d", received.Load())
+	}
+}
+
 func TestPushPayload(t *testing.T) {
 	t.Run("TitleOnly", func(t *testing.T) {
 		data, err := pushPayload(NotifyRequest{Title: "Hello"})
@@ -219,6 +1666,228 @@ func TestPushPayload(t *testing.T) {
 			t.Errorf("data.url: got %v", dataObj["url"])
 		}
 	})
+
+	t.Run("DeclarativeEnvelope", func(t *testing.T) {
+		badge := int64(3)
+		data, err := pushPayload(NotifyRequest{
+			Title:    "Title",
+			Navigate: "https://app.example.com/inbox",
+			AppBadge: &badge,
+			Mutable:  true,
+		})
+		if err != nil {
+			t.Fatalf("pushPayload: %v", err)
+		}
+		var got map[string]any
+		json.Unmarshal(data, &got)
+
+		if got["app_badge"] != float64(3) {
+			t.Errorf("app_badge: got %v", got["app_badge"])
+		}
+		if got["mutable"] != true {
+			t.Errorf("mutable: got %v", got["mutable"])
+		}
+		notif := got["notification"].(map[string]any)
+		if notif["navigate"] != "https://app.example.com/inbox" {
+			t.Errorf("navigate: got %v", notif["navigate"])
+		}
+		if _, exists := notif["app_badge"]; exists {
+			t.Error("expected app_badge outside of the notification object")
+		}
+	})
+
+	t.Run("RichOptionsLegacy", func(t *testing.T) {
+		data, err := pushPayload(NotifyRequest{
+			Title:              "Build finished",
+			Image:              "/preview.png",
+			Tag:                "build-42",
+			Dir:                "ltr",
+			Timestamp:          1700000000000,
+			Renotify:           true,
+			RequireInteraction: true,
+			Vibrate:            []int{200, 100, 200},
+			Actions: []NotificationAction{
+				{Action: "open", Title: "Open", Navigate: "https://ci.example.com/42"},
+			},
+			Legacy: true,
+		})
+		if err != nil {
+			t.Fatalf("pushPayload: %v", err)
+		}
+		var got map[string]any
+		json.Unmarshal(data, &got)
+
+		if _, exists := got["web_push"]; exists {
+			t.Error("expected no web_push key in legacy payload")
+		}
+		if got["image"] != "/preview.png" || got["dir"] != "ltr" {
+			t.Errorf("image/dir: got %v/%v", got["image"], got["dir"])
+		}
+		if got["timestamp"] != float64(1700000000000) {
+			t.Errorf("timestamp: got %v", got["timestamp"])
+		}
+		if got["renotify"] != true || got["require_interaction"] != true {
+			t.Errorf("renotify/require_interaction: got %v/%v", got["renotify"], got["require_interaction"])
+		}
+		if v, _ := got["vibrate"].([]any); len(v) != 3 {
+			t.Errorf("vibrate: got %v", got["vibrate"])
+		}
+		actions, _ := got["actions"].([]any)
+		if len(actions) != 1 {
+			t.Fatalf("actions: got %v", got["actions"])
+		}
+		action := actions[0].(map[string]any)
+		if action["action"] != "open" || action["navigate"] != "https://ci.example.com/42" {
+			t.Errorf("actions[0]: got %v", action)
+		}
+		if _, exists := action["icon"]; exists {
+			t.Error("expected empty action icon to be omitted")
+		}
+	})
+}
+
+func TestValidateNotifyRequest(t *testing.T) {
+	silent := true
+	tests := []struct {
+		name  string
+		req   NotifyRequest
+		valid bool
+	}{
+		{"TitleOnly", NotifyRequest{Title: "x"}, true},
+		{"MissingTitle", NotifyRequest{}, false},
+		{"BadDir", NotifyRequest{Title: "x", Dir: "up"}, false},
+		{"RenotifyWithoutTag", NotifyRequest{Title: "x", Renotify: true}, false},
+		{"RenotifyWithTag", NotifyRequest{Title: "x", Renotify: true, Tag: "t"}, true},
+		{"SilentVibrate", NotifyRequest{Title: "x", Silent: &silent, Vibrate: []int{100}}, false},
+		{"NegativeVibrate", NotifyRequest{Title: "x", Vibrate: []int{-1}}, false},
+		{"ActionMissingTitle", NotifyRequest{Title: "x", Actions: []NotificationAction{{Action: "a"}}}, false},
+		{"DuplicateAction", NotifyRequest{Title: "x", Actions: []NotificationAction{{Action: "a", Title: "A"}, {Action: "a", Title: "B"}}}, false},
+		{"ActionRelativeNavigate", NotifyRequest{Title: "x", Actions: []NotificationAction{{Action: "a", Title: "A", Navigate: "/page"}}}, false},
+		{"ActionHTTPSNavigate", NotifyRequest{Title: "x", Actions: []NotificationAction{{Action: "a", Title: "A", Navigate: "https://example.com/page"}}}, true},
+		{"RelativeNavigate", NotifyRequest{Title: "x", Navigate: "/inbox"}, false},
+		{"HTTPNavigate", NotifyRequest{Title: "x", Navigate: "http://example.com/inbox"}, false},
+		{"MutableLegacy", NotifyRequest{Title: "x", Mutable: true, Legacy: true}, false},
+		{"StrictWithoutNavigate", NotifyRequest{Title: "x", Strict: true}, false},
+		{"StrictLegacy", NotifyRequest{Title: "x", Navigate: "https://example.com", Strict: true, Legacy: true}, false},
+		{"StrictActionWithoutNavigate", NotifyRequest{Title: "x", Navigate: "https://example.com", Strict: true, Actions: []NotificationAction{{Action: "a", Title: "A"}}}, false},
+		{"Strict", NotifyRequest{Title: "x", Navigate: "https://example.com", Strict: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNotifyRequest(tt.req)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestFitPayload(t *testing.T) {
+	if maxPayloadSize != 3993 {
+		t.Errorf("expected max payload size 3993, got %d", maxPayloadSize)
+	}
+
+	long := strings.Repeat("é", 3000) // 6000 bytes of UTF-8
+
+	t.Run("SmallPayload", func(t *testing.T) {
+		req := NotifyRequest{Title: "Hello", Body: "World"}
+		truncated, err := fitPayload(&req)
+		if err != nil || truncated {
+			t.Fatalf("expected small payload to fit untouched, got truncated=%v err=%v", truncated, err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		req := NotifyRequest{Title: "Hello", Body: long}
+		_, err := fitPayload(&req)
+		var tooLarge *PayloadTooLargeError
+		if !errors.As(err, &tooLarge) {
+			t.Fatalf("expected PayloadTooLargeError, got %v", err)
+		}
+		if tooLarge.Size.Excess <= 0 || tooLarge.Size.Payload-tooLarge.Size.Excess != maxPayloadSize {
+			t.Errorf("unexpected size breakdown: %+v", tooLarge.Size)
+		}
+		if req.Body != long {
+			t.Error("expected body to be left untouched without truncate")
+		}
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		req := NotifyRequest{Title: "Hello", Body: long, Truncate: true}
+		truncated, err := fitPayload(&req)
+		if err != nil {
+			t.Fatalf("fitPayload: %v", err)
+		}
+		if !truncated {
+			t.Error("expected truncated=true")
+		}
+		if !strings.HasSuffix(req.Body, "…") || !utf8.ValidString(req.Body) {
+			t.Errorf("expected valid UTF-8 body ending with an ellipsis, got %q...", req.Body[:20])
+		}
+		payload, _ := pushPayload(req)
+		if len(payload) > maxPayloadSize {
+			t.Errorf("truncated payload is %d bytes, over the %d limit", len(payload), maxPayloadSize)
+		}
+		if len(payload) < maxPayloadSize-4 {
+			t.Errorf("truncated payload is %d bytes, expected it to use the available space", len(payload))
+		}
+	})
+}
+
+func TestApplyTemplate(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	defer db.Close()
+
+	created, err := UpsertTemplate(db, Template{
+		Name:  "comment",
+		Title: "{{.author}} commented",
+		Body:  "{{.text}}",
+		Icon:  "/icons/comment.png",
+		Data:  map[string]any{"url": "/posts/{{.post}}", "kind": "comment", "count": float64(1)},
+	})
+	if err != nil {
+		t.Fatalf("UpsertTemplate: %v", err)
+	}
+	if !created {
+		t.Error("expected created=true for new template")
+	}
+
+	req := NotifyRequest{
+		Template: "comment",
+		Vars:     map[string]any{"author": "Alice", "text": "Nice!", "post": 42},
+		Icon:     "/icons/override.png",
+		Data:     map[string]any{"kind": "reply"},
+	}
+	if err := applyTemplate(db, &req); err != nil {
+		t.Fatalf("applyTemplate: %v", err)
+	}
+	if req.Title != "Alice commented" || req.Body != "Nice!" {
+		t.Errorf("unexpected title/body: %q / %q", req.Title, req.Body)
+	}
+	if req.Icon != "/icons/override.png" {
+		t.Errorf("expected request icon to take precedence, got %q", req.Icon)
+	}
+	if req.Data["url"] != "/posts/42" || req.Data["kind"] != "reply" || req.Data["count"] != float64(1) {
+		t.Errorf("unexpected data: %v", req.Data)
+	}
+
+	// Missing vars are an error rather than "<no value>".
+	req = NotifyRequest{Template: "comment", Vars: map[string]any{"author": "Bob"}}
+	if err := applyTemplate(db, &req); err == nil {
+		t.Error("expected an error for missing vars")
+	}
+
+	req = NotifyRequest{Template: "missing"}
+	if err := applyTemplate(db, &req); !errors.Is(err, errTemplateNotFound) {
+		t.Errorf("expected errTemplateNotFound, got %v", err)
+	}
 }
 
 func newTestServer(t *testing.T) *Server {
@@ -268,6 +1937,35 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 
+	// GET /client.js and /sw.js — embedded scripts, revalidated by ETag
+	t.Run("Scripts", func(t *testing.T) {
+		for _, path := range []string{"/client.js", "/sw.js"} {
+			resp, err := client.Get(ts.URL + path)
+			if err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/javascript") || !strings.Contains(string(body), `const VERSION = "`) {
+				t.Fatalf("GET %s: expected a versioned script, got %d %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+
+			req, _ := http.NewRequest("GET", ts.URL+path, nil)
+			req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+			resp, err = client.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotModified {
+				t.Errorf("GET %s with its ETag: expected 304, got %d", path, resp.StatusCode)
+			}
+			if path == "/sw.js" && resp.Header.Get("Service-Worker-Allowed") != "/" {
+				t.Errorf("expected Service-Worker-Allowed: /, got %q", resp.Header.Get("Service-Worker-Allowed"))
+			}
+		}
+	})
+
 	// POST /subscriptions — create a subscription
 	t.Run("PostSubscription", func(t *testing.T) {
 		payload := `{"topic":"test","subscription":{"endpoint":"https://push.example.com/test","keys":{"p256dh":"dGVzdA","auth":"dGVzdA"}}}`
@@ -350,6 +2048,131 @@ func TestHandlers(t *testing.T) {
 		}
 	})
 
+	// POST /topics/{topic}/notify — oversized payload is rejected before fan-out
+	t.Run("TopicNotifyPayloadTooLarge", func(t *testing.T) {
+		notifyPayload := `{"title":"Hello","body":"` + strings.Repeat("x", 5000) + `"}`
+		resp, err := client.Post(ts.URL+"/topics/topictest/notify", "application/json", strings.NewReader(notifyPayload))
+		if err != nil {
+			t.Fatalf("POST /topics/topictest/notify: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected 413, got %d", resp.StatusCode)
+		}
+		var body struct {
+			Size PayloadSize `json:"size"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Size.MaxPayload != maxPayloadSize || body.Size.Excess == 0 {
+			t.Errorf("expected size breakdown in response, got %+v", body.Size)
+		}
+	})
+
+	// POST /topics/{topic}/notify — Idempotency-Key replays the stored result
+	t.Run("TopicNotifyIdempotencyKey", func(t *testing.T) {
+		post := func(body string) *http.Response {
+			req, _ := http.NewRequest("POST", ts.URL+"/topics/idem/notify", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "retry-1")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("POST /topics/idem/notify: %v", err)
+			}
+			return resp
+		}
+
+		resp := post(`{"title":"Once"}`)
+		first, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Fatalf("expected fresh 200, got %d (replayed=%q)", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+		}
+
+		resp = post(`{"title":"Once"}`)
+		replay, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" || string(replay) != string(first) {
+			t.Errorf("expected replayed result %s, got %d %s", first, resp.StatusCode, replay)
+		}
+
+		resp = post(`{"title":"Twice"}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("expected 409 for a different body, got %d", resp.StatusCode)
+		}
+
+		// A reservation whose request never completed expires after its lease.
+		if _, ok, _ := ReserveIdempotencyKey(srv.DB, "POST /topics/idem/notify", "stuck", "h"); !ok {
+			t.Fatal("expected to reserve a new key")
+		}
+		if _, ok, _ := ReserveIdempotencyKey(srv.DB, "POST /topics/idem/notify", "stuck", "h"); ok {
+			t.Error("expected an in-flight key to stay reserved")
+		}
+		srv.DB.Exec(`UPDATE idempotency_keys SET created_at = datetime('now', '-11 minutes') WHERE key = 'stuck'`)
+		if _, ok, _ := ReserveIdempotencyKey(srv.DB, "POST /topics/idem/notify", "stuck", "h"); !ok {
+			t.Error("expected an expired lease to be reclaimed")
+		}
+
+		// A panicking handler releases its key.
+		handler := srv.idempotent(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+		req := httptest.NewRequest("POST", "/panics", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "panic-1")
+		func() {
+			defer func() { recover() }()
+			handler(httptest.NewRecorder(), req)
+		}()
+		if _, ok, _ := ReserveIdempotencyKey(srv.DB, "POST /panics", "panic-1", "h"); !ok {
+			t.Error("expected the key of a panicked request to be released")
+		}
+	})
+
+	// PUT /templates/{name} + POST /templates/{name}/preview
+	t.Run("TemplatePreview", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", ts.URL+"/templates/greeting", strings.NewReader(`{"title":"Hello {{.name}}","body":"Welcome"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("PUT /templates/greeting: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", resp.StatusCode)
+		}
+
+		req, _ = http.NewRequest("POST", ts.URL+"/templates/greeting/preview", strings.NewReader(`{"vars":{"name":"Alice"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("POST /templates/greeting/preview: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body["title"] != "Hello Alice" {
+			t.Errorf("expected rendered title, got %v", body["title"])
+		}
+	})
+
+	// PUT /templates/{name} — invalid template syntax is rejected
+	t.Run("TemplateInvalid", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", ts.URL+"/templates/broken", strings.NewReader(`{"title":"Hello {{.name"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-key")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("PUT /templates/broken: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", resp.StatusCode)
+		}
+	})
+
 	// POST /topics//notify — missing topic returns 404 (no route match)
 	t.Run("TopicNotifyNoTopic", func(t *testing.T) {
 		resp, err := client.Post(ts.URL+"/topics//notify", "application/json", strings.NewReader(`{"title":"x"}`))
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// Notification is a notification sent through SendNotifications, kept so it
+// can later be updated or retracted.
+type Notification struct {
+	ID          string
+	Topic       string
+	Request     NotifyRequest
+	CreatedAt   string
+	UpdatedAt   string
+	RetractedAt string
+}
+
+var errNotificationNotFound = errors.New("notification not found")
+
+// newNotificationID assigns req a new notification ID. Requests that already
+// have an ID are unchanged.
+func newNotificationID(req *NotifyRequest) {
+	if req.ID == "" {
+		req.ID = randomID()
+	}
+}
+
+// RecordNotification stores a notification under req.ID.
+func RecordNotification(db *sql.DB, req NotifyRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal notification: %w", err)
+	}
+	_, err = db.Exec(`INSERT INTO notifications (id, topic, request) VALUES (?, ?, ?)`, req.ID, req.Topic, string(data))
+	return err
+}
+
+// GetNotification returns a notification by ID, or errNotificationNotFound.
+func GetNotification(db *sql.DB, id string) (Notification, error) {
+	var n Notification
+	var request string
+	err := db.QueryRow(`SELECT id, topic, request, created_at, updated_at, retracted_at FROM notifications WHERE id = ?`, id).
+		Scan(&n.ID, &n.Topic, &request, &n.CreatedAt, &n.UpdatedAt, &n.RetractedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Notification{}, errNotificationNotFound
+	}
+	if err != nil {
+		return Notification{}, fmt.Errorf("query notification: %w", err)
+	}
+	if err := json.Unmarshal([]byte(request), &n.Request); err != nil {
+		return Notification{}, fmt.Errorf("decode notification: %w", err)
+	}
+	n.Request.ID = n.ID
+	return n, nil
+}
+
+// UpdateNotification replaces the stored request of a notification and of
+// its queued sends. Returns the number of queued sends updated.
+func UpdateNotification(db *sql.DB, req NotifyRequest) (int, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return 0, fmt.Errorf("marshal notification: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin update notification: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE notifications SET request = ?, updated_at = datetime('now') WHERE id = ?`, string(data), req.ID); err != nil {
+		return 0, fmt.Errorf("update notification: %w", err)
+	}
+
+	var queued int64
+	for _, table := range []string{"deferred_notifications", "digest_events"} {
+		result, err := tx.Exec(`UPDATE `+table+` SET request = ? WHERE notification_id = ?`, string(data), req.ID)
+		if err != nil {
+			return 0, fmt.Errorf("update %s: %w", table, err)
+		}
+		n, _ := result.RowsAffected()
+		queued += n
+	}
+	return int(queued), tx.Commit()
+}
+
+// PurgeNotifications deletes notification records older than the given duration.
+func PurgeNotifications(db *sql.DB, olderThan time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-olderThan).Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`DELETE FROM notifications WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RetractNotification marks a notification as retracted and removes its
+// queued sends (quiet hours deferrals and pending digest events). Returns
+// the number of queued sends removed.
+func RetractNotification(db *sql.DB, id string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin retract: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE notifications SET retracted_at = datetime('now') WHERE id = ?`, id); err != nil {
+		return 0, fmt.Errorf("mark retracted: %w", err)
+	}
+
+	var cancelled int64
+	for _, table := range []string{"deferred_notifications", "digest_events"} {
+		result, err := tx.Exec(`DELETE FROM `+table+` WHERE notification_id = ?`, id)
+		if err != nil {
+			return 0, fmt.Errorf("cancel %s: %w", table, err)
+		}
+		n, _ := result.RowsAffected()
+		cancelled += n
+	}
+	return int(cancelled), tx.Commit()
+}
+
+// GetDeliveredSubscriptions returns the subscriptions that successfully
+// received a notification.
+func GetDeliveredSubscriptions(db *sql.DB, notificationID string) ([]Subscription, error) {
+	rows, err := db.Query(`
+		SELECT `+subscriptionColumns+` FROM subscriptions WHERE id IN (
+			SELECT subscription_id FROM delivery_log
+			WHERE notification_id = ? AND status_code BETWEEN 200 AND 299
+		)
+	`, notificationID)
+	if err != nil {
+		return nil, fmt.Errorf("query delivered subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// RetractResult is the JSON response for DELETE /notifications/{id}:
+// the queued sends cancelled, the outcome of the retract pushes and the
+// deliveries of an untagged notification, which cannot be closed.
+type RetractResult struct {
+	Cancelled int `json:"cancelled"`
+	Unclosed  int `json:"unclosed,omitempty"`
+	NotifyResult
+}
+
+// UpdateResult is the JSON response for PATCH /notifications/{id}: the
+// queued sends updated and the outcome of the update pushes.
+type UpdateResult struct {
+	Queued int `json:"queued"`
+	NotifyResult
+}
+
+// retractRequest builds the follow-up push telling the service worker to
+// close a delivered notification. It is always a legacy payload so the
+// service worker is woken up instead of a new notification being shown.
+func retractRequest(n Notification) NotifyRequest {
+	return NotifyRequest{
+		ID:      n.ID,
+		Topic:   n.Topic,
+		Title:   n.Request.Title,
+		Tag:     n.Request.Tag,
+		Data:    map[string]any{"retract": true, "notification_id": n.ID},
+		Legacy:  true,
+		Urgency: string(webpush.UrgencyHigh),
+	}
+}
+
+// HandleRetractNotification cancels the queued sends of a notification and
+// asks the subscriptions that received it to close it (admin).
+func (s *Server) HandleRetractNotification(w http.ResponseWriter, r *http.Request) {
+	n, err := GetNotification(s.DB, r.PathValue("id"))
+	if errors.Is(err, errNotificationNotFound) {
+		writeError(w, http.StatusNotFound, "notification not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get notification")
+		return
+	}
+	if n.RetractedAt != "" {
+		writeError(w, http.StatusConflict, "notification already retracted")
+		return
+	}
+
+	cancelled, err := RetractNotification(s.DB, n.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to retract notification")
+		return
+	}
+
+	subs, err := GetDeliveredSubscriptions(s.DB, n.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+
+	s.WG.Add(1)
+	defer s.WG.Done()
+	var nr NotifyResult
+	unclosed := 0
+	switch {
+	case n.Request.Tag == "" && len(subs) > 0:
+		// Without a tag the service worker cannot tell which notification
+		// to close.
+		unclosed = len(subs)
+		log.Printf("retract notification=%s: cancelled=%d, unclosed=%d untagged deliveries", n.ID, cancelled, unclosed)
+	case len(subs) > 0:
+		nr = s.deliver(subs, retractRequest(n), nr, false)
+	default:
+		log.Printf("retract notification=%s: cancelled=%d, no deliveries to retract", n.ID, cancelled)
+	}
+	nr.ID = n.ID
+	if !s.verbose(r) {
+		nr.Deliveries = nil
+	}
+	writeJSON(w, http.StatusOK, RetractResult{Cancelled: cancelled, Unclosed: unclosed, NotifyResult: nr})
+}
+
+// HandleUpdateNotification resends a notification with updated content to
+// the subscriptions that received it, replacing it in place (admin). Fields
+// in the body override the original's; the topic, tag and audience cannot
+// change, and renotify is off.
+func (s *Server) HandleUpdateNotification(w http.ResponseWriter, r *http.Request) {
+	n, err := GetNotification(s.DB, r.PathValue("id"))
+	if errors.Is(err, errNotificationNotFound) {
+		writeError(w, http.StatusNotFound, "notification not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get notification")
+		return
+	}
+	if n.RetractedAt != "" {
+		writeError(w, http.StatusConflict, "notification was retracted")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	// The update is decoded on its own first to learn which fields it sets.
+	var update NotifyRequest
+	if err := json.Unmarshal(body, &update); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	// The stored request already has its template rendered; only re-apply
+	// a template named in the update, rendering its title, body and icon
+	// again unless the update sets them.
+	req := n.Request
+	req.Template = ""
+	if update.Template != "" {
+		req.Title, req.Body, req.Icon = "", "", ""
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.Topic != n.Request.Topic || req.Tag != n.Request.Tag || req.DryRun != n.Request.DryRun ||
+		!slices.Equal(req.SubscriptionIDs, n.Request.SubscriptionIDs) {
+		writeError(w, http.StatusBadRequest, "topic, tag, dry_run and subscription_ids cannot be updated")
+		return
+	}
+	req.ID = n.ID
+	req.Renotify = false
+	if req.Tag == "" {
+		// The untagged original cannot be replaced, but later updates and
+		// a retract can replace this one.
+		req.Tag = n.ID
+	}
+
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+
+	queued, err := UpdateNotification(s.DB, req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to update notification")
+		return
+	}
+
+	subs, err := GetDeliveredSubscriptions(s.DB, n.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+
+	s.WG.Add(1)
+	defer s.WG.Done()
+	var nr NotifyResult
+	if len(subs) > 0 {
+		nr = s.deliver(subs, req, nr, false)
+	}
+	nr.ID = n.ID
+	nr.Truncated = truncated
+	if !s.verbose(r) {
+		nr.Deliveries = nil
+	}
+	writeJSON(w, http.StatusOK, UpdateResult{Queued: queued, NotifyResult: nr})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// ntfyMaxBody is the largest message body accepted by the ntfy publish
+// endpoints. Longer messages are truncated to fit the push payload anyway.
+const ntfyMaxBody = 64 << 10
+
+// reservedTopics are the first path segments of the server's own endpoints.
+// They cannot be topic names, since POST /{topic} for them would either hit
+// the server's endpoint or shadow one added later.
+var reservedTopics = map[string]bool{
+	"admin":            true,
+	"client.js":        true,
+	"delivery-log":     true,
+	"events":           true,
+	"gotify":           true,
+	"hooks":            true,
+	"integrations":     true,
+	"message":          true,
+	"notifications":    true,
+	"notify":           true,
+	"stats":            true,
+	"subscriptions":    true,
+	"sw.js":            true,
+	"t":                true,
+	"templates":        true,
+	"topics":           true,
+	"vapid-public-key": true,
+	"webhooks":         true,
+}
+
+// reservedTopicMsg is the error returned for a topic in reservedTopics.
+const reservedTopicMsg = "topic name is reserved by the server"
+
+// ntfyMessage is a message in ntfy's JSON format: the body of a JSON publish
+// and the response to every publish.
+type ntfyMessage struct {
+	ID       string       `json:"id,omitempty"`
+	Time     int64        `json:"time,omitempty"`
+	Event    string       `json:"event,omitempty"`
+	Topic    string       `json:"topic"`
+	Title    string       `json:"title,omitempty"`
+	Message  string       `json:"message,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+	Click    string       `json:"click,omitempty"`
+	Icon     string       `json:"icon,omitempty"`
+	Actions  []ntfyAction `json:"actions,omitempty"`
+}
+
+// ntfyAction is an ntfy action button. Only "view" actions opening an https
+// URL have a Web Push equivalent; others are dropped.
+type ntfyAction struct {
+	Action string `json:"action"`
+	Label  string `json:"label"`
+	URL    string `json:"url,omitempty"`
+}
+
+// ntfyEmojis maps common ntfy tags to the emoji prepended to the title.
+var ntfyEmojis = map[string]string{
+	"+1":                      "👍",
+	"-1":                      "👎",
+	"bell":                    "🔔",
+	"bug":                     "🐛",
+	"cd":                      "💿",
+	"computer":                "💻",
+	"facepalm":                "🤦",
+	"fire":                    "🔥",
+	"heavy_check_mark":        "✔️",
+	"hourglass":               "⌛",
+	"information_source":      "ℹ️",
+	"loudspeaker":             "📢",
+	"no_entry":                "⛔",
+	"no_entry_sign":           "🚫",
+	"partying_face":           "🥳",
+	"rocket":                  "🚀",
+	"rotating_light":          "🚨",
+	"skull":                   "💀",
+	"tada":                    "🎉",
+	"triangular_flag_on_post": "🚩",
+	"warning":                 "⚠️",
+	"white_check_mark":        "✅",
+	"x":                       "❌",
+	"zap":                     "⚡",
+}
+
+// ntfyParam returns a publish option, looked up like ntfy does: in the
+// X-prefixed and plain headers, then in the query parameters, under each of
+// its aliases. Header values may be RFC 2047 encoded for non-ASCII text.
+func ntfyParam(r *http.Request, names ...string) string {
+	for _, name := range names {
+		for _, key := range []string{"X-" + name, name} {
+			if v := r.Header.Get(key); v != "" {
+				if decoded, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+					return decoded
+				}
+				return v
+			}
+		}
+	}
+	for _, name := range names {
+		if v := r.URL.Query().Get(strings.ToLower(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseNtfyPriority parses an ntfy priority, 1 (min) to 5 (max), given as a
+// number or a name. Empty is the default priority, 3.
+func parseNtfyPriority(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "", "3", "default":
+		return 3, nil
+	case "1", "min":
+		return 1, nil
+	case "2", "low":
+		return 2, nil
+	case "4", "high":
+		return 4, nil
+	case "5", "max", "urgent":
+		return 5, nil
+	}
+	return 0, fmt.Errorf("invalid priority %q (use 1-5 or min, low, default, high, max)", s)
+}
+
+// ntfyRequest maps an ntfy message onto a notification to its topic.
+// Priorities map to urgencies: 1 and 2 are also silent, 4 and 5 are high
+// urgency (delivered during quiet hours) and 5 stays on screen. Tags known
+// as emojis prefix the title; all tags are passed in data.tags.
+func ntfyRequest(m ntfyMessage, defaultTitle string) (NotifyRequest, error) {
+	req := NotifyRequest{
+		Topic:    m.Topic,
+		Title:    m.Title,
+		Body:     m.Message,
+		Icon:     m.Icon,
+		Truncate: true,
+	}
+	if req.Title == "" {
+		req.Title = defaultTitle
+	}
+	if req.Body == "" {
+		req.Body = "triggered"
+	}
+
+	var emojis []string
+	for _, tag := range m.Tags {
+		if e, ok := ntfyEmojis[tag]; ok {
+			emojis = append(emojis, e)
+		}
+	}
+	if len(emojis) > 0 {
+		req.Title = strings.Join(emojis, " ") + " " + req.Title
+	}
+
+	data := make(map[string]any)
+	if len(m.Tags) > 0 {
+		data["tags"] = m.Tags
+	}
+	if m.Click != "" {
+		data["url"] = m.Click
+		if isHTTPSURL(m.Click) {
+			req.Navigate = m.Click
+		}
+	}
+	if len(data) > 0 {
+		req.Data = data
+	}
+
+	for i, a := range m.Actions {
+		if a.Action != "view" || !isHTTPSURL(a.URL) {
+			continue
+		}
+		if a.Label == "" {
+			a.Label = "Open"
+		}
+		req.Actions = append(req.Actions, NotificationAction{Action: "view-" + strconv.Itoa(i), Title: a.Label, Navigate: a.URL})
+	}
+
+	silent := true
+	switch m.Priority {
+	case 1:
+		req.Urgency = string(webpush.UrgencyVeryLow)
+		req.Silent = &silent
+	case 2:
+		req.Urgency = string(webpush.UrgencyLow)
+		req.Silent = &silent
+	case 0, 3:
+		req.Urgency = string(webpush.UrgencyNormal)
+	case 4:
+		req.Urgency = string(webpush.UrgencyHigh)
+	case 5:
+		req.Urgency = string(webpush.UrgencyHigh)
+		req.RequireInteraction = true
+	default:
+		return NotifyRequest{}, fmt.Errorf("invalid priority %d (use 1-5)", m.Priority)
+	}
+	return req, nil
+}
+
+// HandleNtfyPublish publishes to a topic the way ntfy does (public): PUT or
+// POST /{topic} with the message as the body and the title, priority, tags,
+// click URL and icon in headers or query parameters.
+func (s *Server) HandleNtfyPublish(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, ntfyMaxBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if len(body) > ntfyMaxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("message exceeds %d bytes", ntfyMaxBody))
+		return
+	}
+	if !utf8.Valid(body) || ntfyParam(r, "Filename", "file", "f") != "" || ntfyParam(r, "Attach", "a") != "" {
+		writeError(w, http.StatusBadRequest, "attachments are not supported")
+		return
+	}
+
+	if reservedTopics[r.PathValue("topic")] {
+		writeError(w, http.StatusBadRequest, reservedTopicMsg)
+		return
+	}
+
+	m := ntfyMessage{
+		Topic:   r.PathValue("topic"),
+		Message: strings.TrimSpace(string(body)),
+		Title:   ntfyParam(r, "Title", "ti", "t"),
+		Click:   ntfyParam(r, "Click"),
+		Icon:    ntfyParam(r, "Icon"),
+	}
+	if v := ntfyParam(r, "Message", "m"); v != "" {
+		m.Message = v
+	}
+	if m.Priority, err = parseNtfyPriority(ntfyParam(r, "Priority", "prio", "p")); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, tag := range strings.Split(ntfyParam(r, "Tags", "Tag", "ta"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	s.publishNtfy(w, m)
+}
+
+// HandleNtfyPublishJSON publishes an ntfy JSON message, naming its topic,
+// posted to the server root (public).
+func (s *Server) HandleNtfyPublishJSON(w http.ResponseWriter, r *http.Request) {
+	var m ntfyMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, ntfyMaxBody)).Decode(&m); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if m.Topic == "" {
+		writeError(w, http.StatusBadRequest, "topic is required")
+		return
+	}
+	if reservedTopics[m.Topic] {
+		writeError(w, http.StatusBadRequest, reservedTopicMsg)
+		return
+	}
+	s.publishNtfy(w, m)
+}
+
+// publishNtfy sends an ntfy message to its topic's subscribers and responds
+// with the message as ntfy would. Untitled messages take the title of the
+// topic config, or the topic name.
+func (s *Server) publishNtfy(w http.ResponseWriter, m ntfyMessage) {
+	defaultTitle := m.Topic
+	if t, err := GetTopicConfig(s.DB, m.Topic); err == nil && t.Title != "" {
+		defaultTitle = t.Title
+	} else if err != nil && !errors.Is(err, errTopicNotFound) {
+		log.Printf("error loading topic %q: %v", m.Topic, err)
+	}
+
+	req, err := ntfyRequest(m, defaultTitle)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := s.checkNotifyRequest(w, &req); !ok {
+		return
+	}
+
+	result := s.SendNotifications(req)
+	m.ID = result.ID
+	m.Time = time.Now().Unix()
+	m.Event = "message"
+	if m.Priority == 0 {
+		m.Priority = 3
+	}
+	writeJSON(w, http.StatusOK, m)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Quiet hours modes: hold notifications until the window ends, or discard them.
+const (
+	quietModeDefer = "defer"
+	quietModeDrop  = "drop"
+)
+
+// QuietHours is a daily window ("22:00" to "07:00") in the subscriber's
+// timezone during which non-urgent notifications are not delivered.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Mode  string `json:"mode,omitempty"`
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// quietUntil reports whether t falls within the subscription's quiet hours
+// and, if so, when they end. Windows may wrap around midnight.
+func (sub Subscription) quietUntil(t time.Time) (time.Time, bool) {
+	if sub.QuietStart == "" || sub.QuietEnd == "" {
+		return time.Time{}, false
+	}
+	start, err1 := parseClock(sub.QuietStart)
+	end, err2 := parseClock(sub.QuietEnd)
+	loc, err3 := time.LoadLocation(sub.Timezone)
+	if err1 != nil || err2 != nil || err3 != nil || start == end {
+		return time.Time{}, false
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	var quiet bool
+	if start < end {
+		quiet = now >= start && now < end
+	} else {
+		quiet = now >= start || now < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, loc)
+	if !until.After(local) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, end/60, end%60, 0, 0, loc)
+	}
+	return until, true
+}
+
+// SetSubscriptionPreferences updates the delivery preferences of every
+// subscription of endpoint, provided auth matches the subscription's auth
+// key. Nil arguments leave the corresponding preference unchanged.
+// Returns false if no subscription matched.
+func SetSubscriptionPreferences(db *sql.DB, endpoint, auth string, locale, timezone *string, quiet *QuietHours) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin preferences: %w", err)
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE endpoint = ? AND key_auth = ?`, endpoint, auth).Scan(&n); err != nil {
+		return false, fmt.Errorf("check subscription: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if locale != nil {
+		if _, err := tx.Exec(`UPDATE subscriptions SET locale = ? WHERE endpoint = ?`, *locale, endpoint); err != nil {
+			return false, fmt.Errorf("update locale: %w", err)
+		}
+	}
+	if timezone != nil {
+		if _, err := tx.Exec(`UPDATE subscriptions SET timezone = ? WHERE endpoint = ?`, *timezone, endpoint); err != nil {
+			return false, fmt.Errorf("update timezone: %w", err)
+		}
+	}
+	if quiet != nil {
+		if _, err := tx.Exec(`UPDATE subscriptions SET quiet_start = ?, quiet_end = ?, quiet_mode = ? WHERE endpoint = ?`,
+			quiet.Start, quiet.End, quiet.Mode, endpoint); err != nil {
+			return false, fmt.Errorf("update quiet hours: %w", err)
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// DeferNotification queues req for delivery to a subscription at deliverAt.
+func DeferNotification(db *sql.DB, subscriptionID string, req NotifyRequest, deliverAt time.Time) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal deferred request: %w", err)
+	}
+	_, err = db.Exec(`INSERT INTO deferred_notifications (subscription_id, notification_id, request, deliver_at) VALUES (?, ?, ?, ?)`,
+		subscriptionID, req.ID, string(data), deliverAt.UTC().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+// DeferredNotification is a queued notification whose deliver_at has passed.
+type DeferredNotification struct {
+	Subscription Subscription
+	Request      NotifyRequest
+}
+
+// TakeDueDeferred removes and returns the deferred notifications due at or
+// before now. Entries whose subscription no longer exists are discarded.
+func TakeDueDeferred(db *sql.DB, now time.Time) ([]DeferredNotification, error) {
+	cutoff := now.UTC().Format("2006-01-02 15:04:05")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin take deferred: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT d.request, d.notification_id, s.id, s.topic, s.endpoint, s.key_p256dh, s.key_auth, s.locale,
+			s.timezone, s.quiet_start, s.quiet_end, s.quiet_mode, s.created_at
+		FROM deferred_notifications d
+		JOIN subscriptions s ON s.id = d.subscription_id
+		WHERE d.deliver_at <= ?
+		ORDER BY d.id
+	`, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("query deferred notifications: %w", err)
+	}
+	var due []DeferredNotification
+	for rows.Next() {
+		var request, notificationID string
+		var sub Subscription
+		err := rows.Scan(&request, &notificationID, &sub.ID, &sub.Topic, &sub.Endpoint, &sub.KeyP256dh, &sub.KeyAuth, &sub.Locale,
+			&sub.Timezone, &sub.QuietStart, &sub.QuietEnd, &sub.QuietMode, &sub.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan deferred notification: %w", err)
+		}
+		var req NotifyRequest
+		if err := json.Unmarshal([]byte(request), &req); err != nil {
+			log.Printf("discarding undecodable deferred notification for %s: %v", sub.ID, err)
+			continue
+		}
+		req.ID = notificationID
+		due = append(due, DeferredNotification{Subscription: sub, Request: req})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM deferred_notifications WHERE deliver_at <= ?`, cutoff); err != nil {
+		return nil, fmt.Errorf("delete deferred notifications: %w", err)
+	}
+	return due, tx.Commit()
+}
+
+// deliverDeferredLoop delivers notifications held back by quiet hours once
+// their window has ended, checking every minute.
+func (s *Server) deliverDeferredLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.deliverDeferred(time.Now())
+		}
+	}
+}
+
+func (s *Server) deliverDeferred(now time.Time) {
+	s.WG.Add(1)
+	defer s.WG.Done()
+
+	due, err := TakeDueDeferred(s.DB, now)
+	if err != nil {
+		log.Printf("deferred delivery error: %v", err)
+		return
+	}
+	for _, d := range due {
+		s.sendToSubscriptions([]Subscription{d.Subscription}, d.Request)
+	}
+}
+
+// HandlePostPreferences updates the delivery preferences of a subscription
+// (public). The caller proves ownership with the subscription's auth key.
+func (s *Server) HandlePostPreferences(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Endpoint   string      `json:"endpoint"`
+		Auth       string      `json:"auth"`
+		Locale     *string     `json:"locale"`
+		Timezone   *string     `json:"timezone"`
+		QuietHours *QuietHours `json:"quiet_hours"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	if body.Endpoint == "" || body.Auth == "" {
+		writeError(w, http.StatusBadRequest, "endpoint and auth are required")
+		return
+	}
+	if body.Locale != nil && *body.Locale != "" && !localeRe.MatchString(*body.Locale) {
+		writeError(w, http.StatusBadRequest, "locale must be a BCP 47 language tag (e.g. \"fr-CA\")")
+		return
+	}
+	if body.Timezone != nil {
+		if _, err := time.LoadLocation(*body.Timezone); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown timezone %q", *body.Timezone))
+			return
+		}
+	}
+	if q := body.QuietHours; q != nil {
+		if q.Start != "" || q.End != "" {
+			if _, err := parseClock(q.Start); err != nil {
+				writeError(w, http.StatusBadRequest, "quiet_hours.start: "+err.Error())
+				return
+			}
+			if _, err := parseClock(q.End); err != nil {
+				writeError(w, http.StatusBadRequest, "quiet_hours.end: "+err.Error())
+				return
+			}
+		}
+		switch q.Mode {
+		case "":
+			if q.Start != "" {
+				q.Mode = quietModeDefer
+			}
+		case quietModeDefer, quietModeDrop:
+		default:
+			writeError(w, http.StatusBadRequest, "quiet_hours.mode must be defer or drop")
+			return
+		}
+	}
+
+	ok, err := SetSubscriptionPreferences(s.DB, body.Endpoint, body.Auth, body.Locale, body.Timezone, body.QuietHours)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save preferences")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// PreviewResult is the JSON response for a dry run: who would receive the
+// notification and what they would receive, without sending anything.
+type PreviewResult struct {
+	DryRun        bool             `json:"dry_run"`
+	Recipients    int              `json:"recipients"`
+	ByPushService map[string]int   `json:"by_push_service"`
+	Deferred      int              `json:"deferred"`
+	Dropped       int              `json:"dropped"`
+	Capped        int              `json:"capped"`
+	Batched       bool             `json:"batched,omitempty"`
+	Truncated     bool             `json:"truncated,omitempty"`
+	UnknownIDs    []string         `json:"unknown_ids,omitempty"`
+	Payloads      []PreviewPayload `json:"payloads"`
+}
+
+// PreviewPayload is the push payload built for one localization of a
+// notification (the default one has an empty Locale).
+type PreviewPayload struct {
+	Locale     string          `json:"locale,omitempty"`
+	Recipients int             `json:"recipients"`
+	Size       PayloadSize     `json:"size"`
+	Content    json.RawMessage `json:"content"`
+}
+
+// PreviewNotification resolves the audience of req the way SendNotifications
+// would, applying quiet hours and frequency caps, and builds its payloads,
+// without delivering, deferring or batching anything.
+func (s *Server) PreviewNotification(req NotifyRequest) (PreviewResult, error) {
+	subs, unknown, err := s.targetSubscriptions(req)
+	if err != nil {
+		return PreviewResult{}, err
+	}
+
+	result := PreviewResult{DryRun: true, ByPushService: make(map[string]int), UnknownIDs: unknown}
+	if req.Topic != "" && req.Urgency != string(webpush.UrgencyHigh) {
+		if result.Batched, err = s.topicBatches(req.Topic); err != nil {
+			return PreviewResult{}, err
+		}
+	}
+
+	a := s.resolveAudience(subs, req, false)
+	result.Recipients = len(a.send)
+	result.Deferred = len(a.deferred)
+	result.Dropped = a.dropped
+	result.Capped = a.capped
+
+	perLocale := make(map[string]int)
+	for _, sub := range a.send {
+		result.ByPushService[pushServiceHost(sub.Endpoint)]++
+		perLocale[matchLocale(req.Localizations, sub.Locale)]++
+	}
+
+	keys := []string{""}
+	for key := range req.Localizations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys[1:])
+	for _, key := range keys {
+		payload, err := pushPayload(localize(req, key))
+		if err != nil {
+			return PreviewResult{}, fmt.Errorf("build push payload: %w", err)
+		}
+		result.Payloads = append(result.Payloads, PreviewPayload{
+			Locale:     key,
+			Recipients: perLocale[key],
+			Size:       measurePayload(payload),
+			Content:    payload,
+		})
+	}
+	return result, nil
+}
+
+// writePreview writes the dry run result for a checked notify request.
+func (s *Server) writePreview(w http.ResponseWriter, req NotifyRequest, truncated bool) {
+	result, err := s.PreviewNotification(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to preview notification")
+		return
+	}
+	result.Truncated = truncated
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandlePreviewNotify previews a notification as a dry run of POST /notify (admin).
+func (s *Server) HandlePreviewNotify(w http.ResponseWriter, r *http.Request) {
+	var req NotifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	req.DryRun = true
+
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+	s.writePreview(w, req, truncated)
+}
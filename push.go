@@ -1,35 +1,222 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"sync"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	webpush "github.com/SherClockHolmes/webpush-go"
 )
 
 // NotifyRequest is the JSON body for POST /notify.
 type NotifyRequest struct {
-	Topic  string         `json:"topic"`
-	Title  string         `json:"title"`
-	Body   string         `json:"body"`
-	Icon   string         `json:"icon,omitempty"`
-	Badge  string         `json:"badge,omitempty"`
-	Tag    string         `json:"tag,omitempty"`
-	Lang   string         `json:"lang,omitempty"`
-	Silent *bool          `json:"silent,omitempty"`
-	Data   map[string]any `json:"data,omitempty"`
-	Legacy bool           `json:"legacy,omitempty"`
+	ID                 string                  `json:"-"` // assigned by SendNotifications
+	Topic              string                  `json:"topic"`
+	Title              string                  `json:"title"`
+	Body               string                  `json:"body"`
+	Navigate           string                  `json:"navigate,omitempty"`
+	Icon               string                  `json:"icon,omitempty"`
+	Badge              string                  `json:"badge,omitempty"`
+	Image              string                  `json:"image,omitempty"`
+	Tag                string                  `json:"tag,omitempty"`
+	Lang               string                  `json:"lang,omitempty"`
+	Dir                string                  `json:"dir,omitempty"`
+	Timestamp          int64                   `json:"timestamp,omitempty"`
+	Renotify           bool                    `json:"renotify,omitempty"`
+	RequireInteraction bool                    `json:"require_interaction,omitempty"`
+	Silent             *bool                   `json:"silent,omitempty"`
+	Vibrate            []int                   `json:"vibrate,omitempty"`
+	Actions            []NotificationAction    `json:"actions,omitempty"`
+	Data               map[string]any          `json:"data,omitempty"`
+	AppBadge           *int64                  `json:"app_badge,omitempty"`
+	Mutable            bool                    `json:"mutable,omitempty"`
+	Legacy             bool                    `json:"legacy,omitempty"`
+	Strict             bool                    `json:"strict,omitempty"`
+	Truncate           bool                    `json:"truncate,omitempty"`
+	Template           string                  `json:"template,omitempty"`
+	Vars               map[string]any          `json:"vars,omitempty"`
+	Localizations      map[string]Localization `json:"localizations,omitempty"`
+	Urgency            string                  `json:"urgency,omitempty"`
+	DryRun             bool                    `json:"dry_run,omitempty"`
+	SubscriptionIDs    []string                `json:"subscription_ids,omitempty"`
+}
+
+// Localization overrides the title and body for subscribers whose locale
+// matches its key in NotifyRequest.Localizations.
+type Localization struct {
+	Title string `json:"title"`
+	Body  string `json:"body,omitempty"`
+}
+
+var localeRe = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// matchLocale picks the localization key to use for a subscriber locale,
+// trying the full tag then dropping subtags ("fr-CA" → "fr"). Matching is
+// case-insensitive. Returns "" when the request's default title and body
+// should be used.
+func matchLocale(localizations map[string]Localization, locale string) string {
+	if len(localizations) == 0 || locale == "" {
+		return ""
+	}
+	for tag := strings.ToLower(locale); tag != ""; {
+		for key := range localizations {
+			if strings.ToLower(key) == tag {
+				return key
+			}
+		}
+		i := strings.LastIndex(tag, "-")
+		if i < 0 {
+			break
+		}
+		tag = tag[:i]
+	}
+	return ""
+}
+
+// localize returns req with the title, body and lang of the given
+// localization key ("" returns req unchanged).
+func localize(req NotifyRequest, key string) NotifyRequest {
+	l, ok := req.Localizations[key]
+	if !ok {
+		return req
+	}
+	req.Title = l.Title
+	req.Body = l.Body
+	req.Lang = key
+	return req
+}
+
+// NotificationAction is a button displayed on the notification.
+type NotificationAction struct {
+	Action   string `json:"action"`
+	Title    string `json:"title"`
+	Icon     string `json:"icon,omitempty"`
+	Navigate string `json:"navigate,omitempty"`
+}
+
+// validateNotifyRequest checks the notification fields of req and returns
+// a client-facing error describing the first problem found.
+func validateNotifyRequest(req NotifyRequest) error {
+	if req.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	if req.Navigate != "" && !isHTTPSURL(req.Navigate) {
+		return fmt.Errorf("navigate must be an absolute https URL")
+	}
+	if req.AppBadge != nil && *req.AppBadge < 0 {
+		return fmt.Errorf("app_badge must not be negative")
+	}
+	if req.Mutable && req.Legacy {
+		return fmt.Errorf("mutable only applies to declarative payloads and cannot be combined with legacy")
+	}
+	if len(req.SubscriptionIDs) > 0 && req.Topic != "" {
+		return fmt.Errorf("topic cannot be combined with subscription_ids")
+	}
+	switch req.Dir {
+	case "", "auto", "ltr", "rtl":
+	default:
+		return fmt.Errorf("dir must be one of auto, ltr, rtl")
+	}
+	if req.Timestamp < 0 {
+		return fmt.Errorf("timestamp must be a positive number of milliseconds since the epoch")
+	}
+	switch webpush.Urgency(req.Urgency) {
+	case "", webpush.UrgencyVeryLow, webpush.UrgencyLow, webpush.UrgencyNormal, webpush.UrgencyHigh:
+	default:
+		return fmt.Errorf("urgency must be one of very-low, low, normal, high")
+	}
+	if req.Renotify && req.Tag == "" {
+		return fmt.Errorf("renotify requires a tag")
+	}
+	if req.Silent != nil && *req.Silent && len(req.Vibrate) > 0 {
+		return fmt.Errorf("vibrate cannot be combined with silent")
+	}
+	for _, v := range req.Vibrate {
+		if v < 0 {
+			return fmt.Errorf("vibrate durations must not be negative")
+		}
+	}
+	seen := make(map[string]bool, len(req.Actions))
+	for i, a := range req.Actions {
+		if a.Action == "" || a.Title == "" {
+			return fmt.Errorf("actions[%d]: action and title are required", i)
+		}
+		if seen[a.Action] {
+			return fmt.Errorf("actions[%d]: duplicate action %q", i, a.Action)
+		}
+		seen[a.Action] = true
+		if a.Navigate != "" && !isHTTPSURL(a.Navigate) {
+			return fmt.Errorf("actions[%d]: navigate must be an absolute https URL", i)
+		}
+	}
+	for key, l := range req.Localizations {
+		if !localeRe.MatchString(key) {
+			return fmt.Errorf("localizations: %q is not a valid language tag", key)
+		}
+		if l.Title == "" {
+			return fmt.Errorf("localizations[%q]: title is required", key)
+		}
+	}
+	if req.Strict {
+		return validateDeclarative(req)
+	}
+	return nil
+}
+
+// validateDeclarative rejects requests that a browser without a service
+// worker (Safari's Declarative Web Push) could not display or act upon.
+func validateDeclarative(req NotifyRequest) error {
+	if req.Legacy {
+		return fmt.Errorf("strict: legacy payloads are not declarative")
+	}
+	if req.Navigate == "" {
+		return fmt.Errorf("strict: navigate is required for declarative notifications")
+	}
+	for i, a := range req.Actions {
+		if a.Navigate == "" {
+			return fmt.Errorf("strict: actions[%d]: navigate is required for declarative notifications", i)
+		}
+	}
+	return nil
+}
+
+// isHTTPSURL reports whether s is an absolute https URL with a host.
+func isHTTPSURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
 }
 
 // NotifyResult is the JSON response for POST /notify.
 type NotifyResult struct {
-	Sent         int `json:"sent"`
-	Failed       int `json:"failed"`
-	StaleRemoved int `json:"stale_removed"`
+	Sent         int              `json:"sent"`
+	Failed       int              `json:"failed"`
+	StaleRemoved int              `json:"stale_removed"`
+	Deferred     int              `json:"deferred,omitempty"`
+	Dropped      int              `json:"dropped,omitempty"`
+	Capped       int              `json:"capped,omitempty"`
+	Truncated    bool             `json:"truncated,omitempty"`
+	Batched      bool             `json:"batched,omitempty"`
+	ID           string           `json:"id,omitempty"`
+	UnknownIDs   []string         `json:"unknown_ids,omitempty"`
+	Deliveries   []DeliveryResult `json:"deliveries,omitempty"`
+}
+
+// DeliveryResult is the outcome of one push attempt, reported by notify
+// endpoints with ?verbose=true.
+type DeliveryResult struct {
+	SubscriptionID string `json:"subscription_id"`
+	PushService    string `json:"push_service"`
+	StatusCode     int    `json:"status_code"`
+	Error          string `json:"error,omitempty"`
+	LatencyMS      int64  `json:"latency_ms"`
+	Removed        bool   `json:"removed"`
 }
 
 // pushPayload builds the JSON payload sent to the browser.
@@ -39,8 +226,15 @@ type NotifyResult struct {
 // service worker.  Other browsers ignore the "web_push" key; the service
 // worker unwraps payload.notification to extract the fields.
 //
+// The envelope also carries the optional "app_badge" (application badge
+// count) and "mutable" (let an installed service worker rewrite the
+// notification before display) members.
+//
 // When req.Legacy is true, the payload omits the "web_push" key so the
 // service worker is always woken up to handle the push event.
+//
+// Field names follow the declarative format (e.g. "require_interaction") in
+// both modes; a legacy service worker maps them to showNotification options.
 func pushPayload(req NotifyRequest) ([]byte, error) {
 	notification := map[string]any{
 		"title": req.Title,
@@ -48,63 +242,331 @@ func pushPayload(req NotifyRequest) ([]byte, error) {
 	if req.Body != "" {
 		notification["body"] = req.Body
 	}
+	if req.Navigate != "" {
+		notification["navigate"] = req.Navigate
+	}
 	if req.Icon != "" {
 		notification["icon"] = req.Icon
 	}
 	if req.Badge != "" {
 		notification["badge"] = req.Badge
 	}
+	if req.Image != "" {
+		notification["image"] = req.Image
+	}
 	if req.Tag != "" {
 		notification["tag"] = req.Tag
 	}
 	if req.Lang != "" {
 		notification["lang"] = req.Lang
 	}
+	if req.Dir != "" {
+		notification["dir"] = req.Dir
+	}
+	if req.Timestamp != 0 {
+		notification["timestamp"] = req.Timestamp
+	}
+	if req.Renotify {
+		notification["renotify"] = true
+	}
+	if req.RequireInteraction {
+		notification["require_interaction"] = true
+	}
 	if req.Silent != nil {
 		notification["silent"] = *req.Silent
 	}
+	if len(req.Vibrate) > 0 {
+		notification["vibrate"] = req.Vibrate
+	}
+	if len(req.Actions) > 0 {
+		notification["actions"] = req.Actions
+	}
 	if len(req.Data) > 0 {
 		notification["data"] = req.Data
 	}
 	if req.Legacy {
+		if req.AppBadge != nil {
+			notification["app_badge"] = *req.AppBadge
+		}
 		return json.Marshal(notification)
 	}
 	payload := map[string]any{
 		"web_push":     8030,
 		"notification": notification,
 	}
+	if req.AppBadge != nil {
+		payload["app_badge"] = *req.AppBadge
+	}
+	if req.Mutable {
+		payload["mutable"] = true
+	}
 	return json.Marshal(payload)
 }
 
+// Encrypted message layout produced by webpush-go: a single aes128gcm
+// record (RFC 8188) whose plaintext is padded up to webpush.MaxRecordSize.
+const (
+	aes128gcmHeaderSize    = 16 + 4 + 1 + 65 // salt, record size, key id length, server public key
+	aes128gcmDelimiterSize = 1               // padding delimiter after the plaintext
+	aes128gcmTagSize       = 16              // AES-GCM authentication tag
+
+	maxPayloadSize = int(webpush.MaxRecordSize) - aes128gcmHeaderSize - aes128gcmDelimiterSize - aes128gcmTagSize
+)
+
+// PayloadSize breaks down how a push payload fits into the encrypted record.
+type PayloadSize struct {
+	Payload    int `json:"payload"`
+	MaxPayload int `json:"max_payload"`
+	Header     int `json:"header"`
+	Delimiter  int `json:"delimiter"`
+	Tag        int `json:"tag"`
+	RecordSize int `json:"record_size"`
+	Excess     int `json:"excess"`
+}
+
+func measurePayload(payload []byte) PayloadSize {
+	return PayloadSize{
+		Payload:    len(payload),
+		MaxPayload: maxPayloadSize,
+		Header:     aes128gcmHeaderSize,
+		Delimiter:  aes128gcmDelimiterSize,
+		Tag:        aes128gcmTagSize,
+		RecordSize: int(webpush.MaxRecordSize),
+		Excess:     max(0, len(payload)-maxPayloadSize),
+	}
+}
+
+// PayloadTooLargeError is returned when a push payload cannot fit in a
+// single encrypted record.
+type PayloadTooLargeError struct {
+	Size PayloadSize
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("push payload is %d bytes, %d over the %d byte limit (%d byte record minus %d bytes of encryption overhead)",
+		e.Size.Payload, e.Size.Excess, e.Size.MaxPayload, e.Size.RecordSize, e.Size.RecordSize-e.Size.MaxPayload)
+}
+
+// fitPayload checks that the payload built from req fits in a push message.
+// If it does not and req.Truncate is set, the body is shortened (with an
+// ellipsis) to the longest prefix that fits. Returns whether the body was
+// truncated, or a *PayloadTooLargeError if the payload still does not fit.
+func fitPayload(req *NotifyRequest) (truncated bool, err error) {
+	payload, err := pushPayload(*req)
+	if err != nil {
+		return false, err
+	}
+	size := measurePayload(payload)
+	if size.Excess == 0 {
+		return false, nil
+	}
+	if !req.Truncate || req.Body == "" {
+		return false, &PayloadTooLargeError{Size: size}
+	}
+
+	// Binary search the number of body runes to keep.
+	body := []rune(req.Body)
+	fits := func(n int) bool {
+		r := *req
+		r.Body = string(body[:n]) + "…"
+		p, err := pushPayload(r)
+		return err == nil && len(p) <= maxPayloadSize
+	}
+	lo, hi := -1, len(body)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if lo < 0 {
+		req.Body = ""
+		if p, err := pushPayload(*req); err == nil && len(p) <= maxPayloadSize {
+			return true, nil
+		}
+		return false, &PayloadTooLargeError{Size: size}
+	}
+	req.Body = string(body[:lo]) + "…"
+	return true, nil
+}
+
+// fitPayloads applies fitPayload to the default notification and to every
+// localization of req. Returns whether any body was truncated.
+func fitPayloads(req *NotifyRequest) (truncated bool, err error) {
+	truncated, err = fitPayload(req)
+	if err != nil {
+		return false, err
+	}
+	for key, l := range req.Localizations {
+		variant := localize(*req, key)
+		t, err := fitPayload(&variant)
+		if err != nil {
+			return false, fmt.Errorf("localizations[%q]: %w", key, err)
+		}
+		if t {
+			l.Body = variant.Body
+			req.Localizations[key] = l
+			truncated = true
+		}
+	}
+	return truncated, nil
+}
+
 const pushConcurrency = 10
 
+// pushServiceHost returns the host of a subscription endpoint, which
+// identifies its push service (e.g. fcm.googleapis.com).
+func pushServiceHost(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
+
 // SendNotifications fetches subscriptions by topic and delivers to all of them.
 // It uses context.Background() so delivery survives HTTP request cancellation.
-// The provided wg is incremented/decremented for graceful shutdown tracking.
-func SendNotifications(db *sql.DB, req NotifyRequest, vapidPublicKey, vapidPrivateKey, vapidContact string, wg *sync.WaitGroup) NotifyResult {
-	wg.Add(1)
-	defer wg.Done()
+// The server's WG is incremented/decremented for graceful shutdown tracking.
+// Non-urgent notifications to a topic with a batching policy are held for
+// the topic's next digest instead.
+//
+// The notification is recorded under req.ID (assigned if empty) so it can
+// later be retracted.
+func (s *Server) SendNotifications(req NotifyRequest) NotifyResult {
+	s.WG.Add(1)
+	defer s.WG.Done()
+
+	newNotificationID(&req)
+	if err := RecordNotification(s.DB, req); err != nil {
+		log.Printf("error recording notification %s: %v", req.ID, err)
+	}
+
+	if req.Topic != "" && req.Urgency != string(webpush.UrgencyHigh) {
+		batched, err := s.batchNotification(req)
+		if err != nil {
+			log.Printf("error batching notification for topic %q: %v", req.Topic, err)
+		} else if batched {
+			return NotifyResult{Batched: true, ID: req.ID}
+		}
+	}
 
-	subs, err := GetSubscriptionsByTopic(db, req.Topic)
+	subs, unknown, err := s.targetSubscriptions(req)
 	if err != nil {
 		log.Printf("error fetching subscriptions: %v", err)
-		return NotifyResult{}
+		return NotifyResult{ID: req.ID}
 	}
 
-	return sendToSubscriptions(db, subs, req, vapidPublicKey, vapidPrivateKey, vapidContact)
+	nr := s.sendToSubscriptions(subs, req)
+	nr.ID = req.ID
+	nr.UnknownIDs = unknown
+	return nr
+}
+
+// targetSubscriptions returns the subscriptions a notification is addressed
+// to: those listed in req.SubscriptionIDs if set (along with the IDs that
+// matched none), or else those of req.Topic (all if empty).
+func (s *Server) targetSubscriptions(req NotifyRequest) ([]Subscription, []string, error) {
+	if len(req.SubscriptionIDs) > 0 {
+		return GetSubscriptionsByIDs(s.DB, req.SubscriptionIDs)
+	}
+	subs, err := GetSubscriptionsByTopic(s.DB, req.Topic)
+	return subs, nil, err
+}
+
+// audience is the outcome of applying quiet hours and frequency caps to the
+// subscriptions targeted by a notification.
+type audience struct {
+	send     []Subscription
+	deferred []deferredSend
+	dropped  int
+	capped   int
+}
+
+// deferredSend is a subscription in its quiet hours, which end at until.
+type deferredSend struct {
+	sub   Subscription
+	until time.Time
+}
+
+// resolveAudience splits subs into those to send to now, those in their
+// quiet hours (deferred or dropped per their preference, unless req.Urgency
+// is "high") and those over a frequency cap. It has no side effects.
+func (s *Server) resolveAudience(subs []Subscription, req NotifyRequest, reserve bool) audience {
+	var a audience
+	if req.Urgency != string(webpush.UrgencyHigh) {
+		now := time.Now()
+		awake := subs[:0:0]
+		for _, sub := range subs {
+			until, quiet := sub.quietUntil(now)
+			switch {
+			case !quiet:
+				awake = append(awake, sub)
+			case sub.QuietMode == quietModeDrop:
+				a.dropped++
+			default:
+				a.deferred = append(a.deferred, deferredSend{sub: sub, until: until})
+			}
+		}
+		subs = awake
+	}
+	a.send, a.capped = s.applyFrequencyCaps(subs, reserve)
+	return a
 }
 
 // sendToSubscriptions fans out push delivery to the given subscriptions.
-func sendToSubscriptions(db *sql.DB, subs []Subscription, req NotifyRequest, vapidPublicKey, vapidPrivateKey, vapidContact string) NotifyResult {
-	payload, err := pushPayload(req)
-	if err != nil {
-		log.Printf("error building push payload: %v", err)
-		return NotifyResult{}
+// Subscribers in their quiet hours have the notification deferred or
+// dropped (per their preference) unless req.Urgency is "high", and
+// subscribers over a frequency cap are skipped.
+func (s *Server) sendToSubscriptions(subs []Subscription, req NotifyRequest) NotifyResult {
+	a := s.resolveAudience(subs, req, true)
+	nr := NotifyResult{Dropped: a.dropped, Capped: a.capped}
+	for _, d := range a.deferred {
+		if err := DeferNotification(s.DB, d.sub.ID, req, d.until); err != nil {
+			log.Printf("error deferring notification for %s: %v", d.sub.ID, err)
+			nr.Failed++
+			continue
+		}
+		nr.Deferred++
+	}
+	return s.deliver(a.send, req, nr, true)
+}
+
+// deliver pushes req to every subscription, bypassing quiet hours and
+// frequency caps, and adds the outcomes to nr. If reserved, subs hold
+// frequency cap reservations, released as each delivery is logged.
+func (s *Server) deliver(subs []Subscription, req NotifyRequest, nr NotifyResult, reserved bool) NotifyResult {
+	// Build one payload per localization actually needed by the subscribers.
+	payloads := make(map[string][]byte)
+	for _, sub := range subs {
+		key := matchLocale(req.Localizations, sub.Locale)
+		if _, ok := payloads[key]; ok {
+			continue
+		}
+		payload, err := pushPayload(localize(req, key))
+		if err != nil {
+			log.Printf("error building push payload: %v", err)
+			if reserved {
+				for _, sub := range subs {
+					s.caps.release(sub)
+				}
+			}
+			return nr
+		}
+		// webpush-go appends the padding to the payload it is given; clip
+		// it so each concurrent send appends to its own copy.
+		payloads[key] = slices.Clip(payload)
+	}
+
+	urgency := webpush.UrgencyHigh
+	if req.Urgency != "" {
+		urgency = webpush.Urgency(req.Urgency)
 	}
 
 	type result struct {
-		sent         bool
-		staleRemoved bool
+		sub      Subscription
+		sent     bool
+		delivery DeliveryResult
 	}
 
 	results := make(chan result, len(subs))
@@ -112,24 +574,27 @@ func sendToSubscriptions(db *sql.DB, subs []Subscription, req NotifyRequest, vap
 
 	for _, sub := range subs {
 		sem <- struct{}{} // acquire slot
-		go func(s Subscription) {
+		go func(sub Subscription) {
 			defer func() { <-sem }() // release slot
 
 			wpSub := &webpush.Subscription{
-				Endpoint: s.Endpoint,
+				Endpoint: sub.Endpoint,
 				Keys: webpush.Keys{
-					P256dh: s.KeyP256dh,
-					Auth:   s.KeyAuth,
+					P256dh: sub.KeyP256dh,
+					Auth:   sub.KeyAuth,
 				},
 			}
 
+			payload := payloads[matchLocale(req.Localizations, sub.Locale)]
+			start := time.Now()
 			resp, err := webpush.SendNotification(payload, wpSub, &webpush.Options{
-				VAPIDPublicKey:  vapidPublicKey,
-				VAPIDPrivateKey: vapidPrivateKey,
-				Subscriber:      vapidContact,
+				VAPIDPublicKey:  s.VAPIDPublicKey,
+				VAPIDPrivateKey: s.VAPIDPrivateKey,
+				Subscriber:      s.VAPIDContact,
 				TTL:             86400,
-				Urgency:         webpush.UrgencyHigh,
+				Urgency:         urgency,
 			})
+			latency := time.Since(start)
 
 			var statusCode int
 			var errMsg string
@@ -138,41 +603,68 @@ func sendToSubscriptions(db *sql.DB, subs []Subscription, req NotifyRequest, vap
 				statusCode = 0
 			} else {
 				statusCode = resp.StatusCode
+				if statusCode < 200 || statusCode >= 300 {
+					body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+					errMsg = strings.TrimSpace(string(body))
+				}
 				resp.Body.Close()
 			}
 
 			// Log delivery attempt.
-			if logErr := LogDelivery(db, s.ID, statusCode, errMsg); logErr != nil {
-				log.Printf("error logging delivery for %s: %v", s.ID, logErr)
+			if logErr := LogDelivery(s.DB, sub.ID, req.ID, statusCode, errMsg); logErr != nil {
+				log.Printf("error logging delivery for %s: %v", sub.ID, logErr)
+			}
+			if reserved {
+				s.caps.release(sub)
 			}
 
 			// Remove stale subscriptions (404 or 410).
 			stale := statusCode == http.StatusNotFound || statusCode == http.StatusGone
 			if stale {
-				if delErr := DeleteSubscriptionByID(db, s.ID); delErr != nil {
-					log.Printf("error deleting stale subscription %s: %v", s.ID, delErr)
+				if _, delErr := DeleteSubscriptionByID(s.DB, sub.ID); delErr != nil {
+					log.Printf("error deleting stale subscription %s: %v", sub.ID, delErr)
 				}
 			}
 
 			sent := err == nil && statusCode >= 200 && statusCode < 300
-			results <- result{sent: sent, staleRemoved: stale}
+			results <- result{sub: sub, sent: sent, delivery: DeliveryResult{
+				SubscriptionID: sub.ID,
+				PushService:    pushServiceHost(sub.Endpoint),
+				StatusCode:     statusCode,
+				Error:          errMsg,
+				LatencyMS:      latency.Milliseconds(),
+				Removed:        stale,
+			}}
 		}(sub)
 	}
 
-	var nr NotifyResult
 	for range len(subs) {
 		r := <-results
+		nr.Deliveries = append(nr.Deliveries, r.delivery)
 		if r.sent {
 			nr.Sent++
-		} else if !r.staleRemoved {
+		} else if !r.delivery.Removed {
 			nr.Failed++
 		}
-		if r.staleRemoved {
+		if r.delivery.Removed {
 			nr.StaleRemoved++
 			nr.Failed++ // stale also counts as failed delivery
 		}
+
+		s.streamEvent(eventDeliveryAttempted, DeliveryEvent{NotificationID: req.ID, Topic: r.sub.Topic, DeliveryResult: r.delivery})
+		if !r.sent {
+			s.publishEvent(eventDeliveryFailed, DeliveryEvent{NotificationID: req.ID, Topic: r.sub.Topic, DeliveryResult: r.delivery})
+		}
+		if r.delivery.Removed {
+			s.publishEvent(eventSubscriptionRemoved, SubscriptionEvent{ID: r.sub.ID, Topic: r.sub.Topic, Endpoint: r.sub.Endpoint, Reason: "stale"})
+		}
 	}
 
-	fmt.Printf("notify topic=%q: sent=%d failed=%d stale_removed=%d\n", req.Topic, nr.Sent, nr.Failed, nr.StaleRemoved)
+	fmt.Printf("notify topic=%q: sent=%d failed=%d stale_removed=%d deferred=%d dropped=%d capped=%d\n", req.Topic, nr.Sent, nr.Failed, nr.StaleRemoved, nr.Deferred, nr.Dropped, nr.Capped)
+
+	completed := NotificationCompletedEvent{Topic: req.Topic, NotifyResult: nr}
+	completed.ID = req.ID
+	completed.Deliveries = nil
+	s.publishEvent(eventNotificationCompleted, completed)
 	return nr
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// Repository events forwarded by the GitHub and GitLab receivers, selected
+// per topic with repo_events.
+const (
+	repoEventPullRequest = "pull_request" // pull/merge request opened, reopened, merged or closed
+	repoEventReview      = "review"       // review or approval submitted, merge request comment
+	repoEventCI          = "ci"           // workflow run or pipeline failed
+	repoEventRelease     = "release"      // release published
+)
+
+var repoEventTypes = []string{repoEventPullRequest, repoEventReview, repoEventCI, repoEventRelease}
+
+// repoWebhookMaxBody is the largest webhook payload accepted. GitHub caps
+// its payloads at 25MB, but the events forwarded are far smaller.
+const repoWebhookMaxBody = 5 << 20
+
+// repoNotification is the notification for a repository event, built by the
+// platform-specific mappers.
+type repoNotification struct {
+	Event string // one of repoEventTypes
+	Title string
+	Body  string
+	URL   string
+	Tag   string // replaces earlier notifications about the same pull request
+}
+
+// request returns the notification to send to topic. It links to the event's
+// page through data.url, and navigate when that is an https URL.
+func (n repoNotification) request(topic, platform string) NotifyRequest {
+	req := NotifyRequest{
+		Topic:    topic,
+		Title:    n.Title,
+		Body:     n.Body,
+		Tag:      n.Tag,
+		Renotify: n.Tag != "",
+		Truncate: true,
+		Data:     map[string]any{"platform": platform, "event": n.Event},
+	}
+	if n.URL != "" {
+		req.Data["url"] = n.URL
+		if isHTTPSURL(n.URL) {
+			req.Navigate = n.URL
+		}
+	}
+	return req
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+type githubPullRequest struct {
+	Number  int        `json:"number"`
+	Title   string     `json:"title"`
+	HTMLURL string     `json:"html_url"`
+	Merged  bool       `json:"merged"`
+	User    githubUser `json:"user"`
+}
+
+// githubEvent holds the fields used from GitHub webhook payloads, across the
+// event types forwarded.
+type githubEvent struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender      githubUser         `json:"sender"`
+	PullRequest *githubPullRequest `json:"pull_request"`
+	Review      *struct {
+		State   string     `json:"state"`
+		Body    string     `json:"body"`
+		HTMLURL string     `json:"html_url"`
+		User    githubUser `json:"user"`
+	} `json:"review"`
+	WorkflowRun *struct {
+		Name         string `json:"name"`
+		DisplayTitle string `json:"display_title"`
+		HeadBranch   string `json:"head_branch"`
+		Conclusion   string `json:"conclusion"`
+		HTMLURL      string `json:"html_url"`
+	} `json:"workflow_run"`
+	Release *struct {
+		TagName    string `json:"tag_name"`
+		Name       string `json:"name"`
+		Body       string `json:"body"`
+		HTMLURL    string `json:"html_url"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+}
+
+// githubNotification maps a GitHub event, named by the X-GitHub-Event header,
+// onto a notification. ok is false for events and actions not forwarded.
+func githubNotification(event string, e githubEvent) (n repoNotification, ok bool) {
+	repo := e.Repository.FullName
+	switch {
+	case event == "pull_request" && e.PullRequest != nil:
+		pr := e.PullRequest
+		verb := map[string]string{"opened": "opened", "reopened": "reopened", "ready_for_review": "ready for review", "closed": "closed"}[e.Action]
+		if verb == "" {
+			return repoNotification{}, false
+		}
+		if e.Action == "closed" && pr.Merged {
+			verb = "merged"
+		}
+		return repoNotification{
+			Event: repoEventPullRequest,
+			Title: fmt.Sprintf("[%s] Pull request #%d %s", repo, pr.Number, verb),
+			Body:  fmt.Sprintf("%s (%s)", pr.Title, e.Sender.Login),
+			URL:   pr.HTMLURL,
+			Tag:   fmt.Sprintf("github:%s#%d", repo, pr.Number),
+		}, true
+
+	case event == "pull_request_review" && e.Action == "submitted" && e.PullRequest != nil && e.Review != nil:
+		pr := e.PullRequest
+		verb := map[string]string{"approved": "approved", "changes_requested": "requested changes on", "commented": "commented on"}[e.Review.State]
+		if verb == "" {
+			return repoNotification{}, false
+		}
+		body := pr.Title
+		if e.Review.Body != "" {
+			body += "\n\n" + e.Review.Body
+		}
+		return repoNotification{
+			Event: repoEventReview,
+			Title: fmt.Sprintf("[%s] %s %s #%d", repo, e.Review.User.Login, verb, pr.Number),
+			Body:  body,
+			URL:   e.Review.HTMLURL,
+			Tag:   fmt.Sprintf("github:%s#%d", repo, pr.Number),
+		}, true
+
+	case event == "workflow_run" && e.Action == "completed" && e.WorkflowRun != nil:
+		run := e.WorkflowRun
+		if run.Conclusion != "failure" && run.Conclusion != "timed_out" && run.Conclusion != "startup_failure" {
+			return repoNotification{}, false
+		}
+		return repoNotification{
+			Event: repoEventCI,
+			Title: fmt.Sprintf("[%s] %s failed on %s", repo, run.Name, run.HeadBranch),
+			Body:  run.DisplayTitle,
+			URL:   run.HTMLURL,
+		}, true
+
+	case event == "release" && e.Action == "published" && e.Release != nil:
+		rel := e.Release
+		kind := "Release"
+		if rel.Prerelease {
+			kind = "Pre-release"
+		}
+		name := rel.Name
+		if name == "" {
+			name = rel.TagName
+		}
+		return repoNotification{
+			Event: repoEventRelease,
+			Title: fmt.Sprintf("[%s] %s %s published", repo, kind, name),
+			Body:  rel.Body,
+			URL:   rel.HTMLURL,
+		}, true
+	}
+	return repoNotification{}, false
+}
+
+// gitlabEvent holds the fields used from GitLab webhook payloads, across the
+// event kinds forwarded.
+type gitlabEvent struct {
+	ObjectKind string `json:"object_kind"`
+	User       struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		ID           int64  `json:"id"`
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		Action       string `json:"action"`
+		URL          string `json:"url"`
+		Status       string `json:"status"`
+		Ref          string `json:"ref"`
+		Name         string `json:"name"`
+		NoteableType string `json:"noteable_type"`
+		Note         string `json:"note"`
+	} `json:"object_attributes"`
+	MergeRequest *struct {
+		IID   int    `json:"iid"`
+		Title string `json:"title"`
+	} `json:"merge_request"`
+	Commit struct {
+		Title string `json:"title"`
+	} `json:"commit"`
+
+	// Release events have their attributes at the top level.
+	Action      string `json:"action"`
+	Name        string `json:"name"`
+	Tag         string `json:"tag"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+}
+
+// gitlabNotification maps a GitLab event onto a notification. ok is false
+// for events and actions not forwarded.
+func gitlabNotification(e gitlabEvent) (n repoNotification, ok bool) {
+	project := e.Project.PathWithNamespace
+	attrs := e.ObjectAttributes
+	switch e.ObjectKind {
+	case "merge_request":
+		tag := fmt.Sprintf("gitlab:%s!%d", project, attrs.IID)
+		if attrs.Action == "approved" {
+			return repoNotification{
+				Event: repoEventReview,
+				Title: fmt.Sprintf("[%s] %s approved !%d", project, e.User.Username, attrs.IID),
+				Body:  attrs.Title,
+				URL:   attrs.URL,
+				Tag:   tag,
+			}, true
+		}
+		verb := map[string]string{"open": "opened", "reopen": "reopened", "merge": "merged", "close": "closed"}[attrs.Action]
+		if verb == "" {
+			return repoNotification{}, false
+		}
+		return repoNotification{
+			Event: repoEventPullRequest,
+			Title: fmt.Sprintf("[%s] Merge request !%d %s", project, attrs.IID, verb),
+			Body:  fmt.Sprintf("%s (%s)", attrs.Title, e.User.Username),
+			URL:   attrs.URL,
+			Tag:   tag,
+		}, true
+
+	case "note":
+		if attrs.NoteableType != "MergeRequest" || e.MergeRequest == nil {
+			return repoNotification{}, false
+		}
+		return repoNotification{
+			Event: repoEventReview,
+			Title: fmt.Sprintf("[%s] %s commented on !%d", project, e.User.Username, e.MergeRequest.IID),
+			Body:  e.MergeRequest.Title + "\n\n" + attrs.Note,
+			URL:   attrs.URL,
+			Tag:   fmt.Sprintf("gitlab:%s!%d", project, e.MergeRequest.IID),
+		}, true
+
+	case "pipeline":
+		if attrs.Status != "failed" {
+			return repoNotification{}, false
+		}
+		name := attrs.Name
+		if name == "" {
+			name = "Pipeline"
+		}
+		link := attrs.URL
+		if link == "" && e.Project.WebURL != "" {
+			link = e.Project.WebURL + "/-/pipelines/" + strconv.FormatInt(attrs.ID, 10)
+		}
+		return repoNotification{
+			Event: repoEventCI,
+			Title: fmt.Sprintf("[%s] %s failed on %s", project, name, attrs.Ref),
+			Body:  e.Commit.Title,
+			URL:   link,
+		}, true
+
+	case "release":
+		if e.Action != "create" {
+			return repoNotification{}, false
+		}
+		name := e.Name
+		if name == "" {
+			name = e.Tag
+		}
+		return repoNotification{
+			Event: repoEventRelease,
+			Title: fmt.Sprintf("[%s] Release %s published", project, name),
+			Body:  e.Description,
+			URL:   e.URL,
+		}, true
+	}
+	return repoNotification{}, false
+}
+
+// verifyGitHubSignature reports whether the X-Hub-Signature-256 header of a
+// GitHub delivery is the HMAC-SHA256 of body with secret, signed the same way
+// as the server's own webhooks.
+func verifyGitHubSignature(secret string, body []byte, header string) bool {
+	return hmac.Equal([]byte(header), []byte(signWebhookPayload(secret, body)))
+}
+
+// HandleGitHubWebhook receives a GitHub webhook signed with the topic's
+// github_secret and notifies the topic's subscribers of the events it
+// forwards (public, authenticated by the signature).
+func (s *Server) HandleGitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	s.handleRepoWebhook(w, r, "github",
+		func(t TopicConfig) string { return t.GitHubSecret },
+		func(secret string, body []byte) bool {
+			return verifyGitHubSignature(secret, body, r.Header.Get("X-Hub-Signature-256"))
+		},
+		func(body []byte) (repoNotification, bool, error) {
+			var e githubEvent
+			if err := json.Unmarshal(body, &e); err != nil {
+				return repoNotification{}, false, err
+			}
+			n, ok := githubNotification(r.Header.Get("X-GitHub-Event"), e)
+			return n, ok, nil
+		})
+}
+
+// HandleGitLabWebhook receives a GitLab webhook carrying the topic's
+// gitlab_token and notifies the topic's subscribers of the events it
+// forwards (public, authenticated by the token).
+func (s *Server) HandleGitLabWebhook(w http.ResponseWriter, r *http.Request) {
+	s.handleRepoWebhook(w, r, "gitlab",
+		func(t TopicConfig) string { return t.GitLabToken },
+		func(secret string, body []byte) bool {
+			return subtle.ConstantTimeCompare([]byte(secret), []byte(r.Header.Get("X-Gitlab-Token"))) == 1
+		},
+		func(body []byte) (repoNotification, bool, error) {
+			var e gitlabEvent
+			if err := json.Unmarshal(body, &e); err != nil {
+				return repoNotification{}, false, err
+			}
+			n, ok := gitlabNotification(e)
+			return n, ok, nil
+		})
+}
+
+// handleRepoWebhook verifies a repository webhook against the secret of its
+// topic, maps it onto a notification and sends it, unless the topic's
+// repo_events leaves it out. Events not forwarded get 204 No Content.
+func (s *Server) handleRepoWebhook(w http.ResponseWriter, r *http.Request, platform string,
+	secretOf func(TopicConfig) string,
+	verify func(secret string, body []byte) bool,
+	notification func(body []byte) (repoNotification, bool, error),
+) {
+	topic := r.PathValue("topic")
+	t, err := GetTopicConfig(s.DB, topic)
+	if errors.Is(err, errTopicNotFound) || err == nil && secretOf(t) == "" {
+		writeError(w, http.StatusForbidden, platform+" webhooks are not enabled for this topic")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get topic")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, repoWebhookMaxBody+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if len(body) > repoWebhookMaxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("payload exceeds %d bytes", repoWebhookMaxBody))
+		return
+	}
+	if !verify(secretOf(t), body) {
+		writeError(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	n, ok, err := notification(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if !ok || len(t.RepoEvents) > 0 && !slices.Contains(t.RepoEvents, n.Event) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	req := n.request(topic, platform)
+	truncated, ok := s.checkNotifyRequest(w, &req)
+	if !ok {
+		return
+	}
+
+	result := s.SendNotifications(req)
+	result.Truncated = truncated
+	if !s.verbose(r) {
+		result.Deliveries = nil
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -16,17 +16,66 @@ func (s *Server) NewRouter(corsOrigin string) http.Handler {
 	mux.HandleFunc("GET /vapid-public-key", s.HandleGetVAPIDPublicKey)
 	mux.HandleFunc("POST /subscriptions", s.HandlePostSubscription)
 	mux.HandleFunc("DELETE /subscriptions", s.HandleDeleteSubscriptionByEndpoint)
-	mux.HandleFunc("POST /topics/{topic}/notify", s.HandleTopicNotify)
+	mux.HandleFunc("POST /subscriptions/rotate", s.HandleRotateSubscription)
+	mux.HandleFunc("POST /subscriptions/preferences", s.HandlePostPreferences)
+	mux.HandleFunc("POST /topics/{topic}/notify", s.idempotent(s.HandleTopicNotify))
+	mux.HandleFunc("GET /client.js", scriptHandler("client.js", nil))
+	mux.HandleFunc("GET /sw.js", scriptHandler("sw.js", map[string]string{"Service-Worker-Allowed": "/"}))
+	mux.HandleFunc("GET /t/{topic}", s.HandleTopicPage)
+
+	// ntfy-compatible publishing (public, like topic notify)
+	mux.HandleFunc("POST /{$}", s.HandleNtfyPublishJSON)
+	mux.HandleFunc("POST /{topic}", s.HandleNtfyPublish)
+	mux.HandleFunc("PUT /{topic}", s.HandleNtfyPublish)
+
+	// Gotify-compatible publishing (app token)
+	mux.HandleFunc("POST /message", s.HandleGotifyMessage)
+
+	// Integrations (public, like topic notify)
+	mux.HandleFunc("POST /integrations/alertmanager/{topic}", s.HandleAlertmanager)
+	mux.HandleFunc("POST /integrations/github/{topic}", s.HandleGitHubWebhook)
+	mux.HandleFunc("POST /integrations/gitlab/{topic}", s.HandleGitLabWebhook)
+
+	// Inbound hooks (hook secret)
+	mux.HandleFunc("POST /hooks/{name}", s.HandleHook)
+
+	mux.Handle("GET /admin/", adminHandler())
 
 	// Admin endpoints
 	mux.HandleFunc("GET /subscriptions", s.requireAuth(s.HandleListSubscriptions))
 	mux.HandleFunc("DELETE /subscriptions/{id}", s.requireAuth(s.HandleDeleteSubscriptionByID))
-	mux.HandleFunc("POST /notify", s.requireAuth(s.HandleNotify))
+	mux.HandleFunc("POST /notify", s.requireAuth(s.idempotent(s.HandleNotify)))
+	mux.HandleFunc("POST /notify/preview", s.requireAuth(s.HandlePreviewNotify))
+	mux.HandleFunc("PATCH /notifications/{id}", s.requireAuth(s.HandleUpdateNotification))
+	mux.HandleFunc("DELETE /notifications/{id}", s.requireAuth(s.HandleRetractNotification))
 	mux.HandleFunc("DELETE /delivery-log", s.requireAuth(s.HandlePurgeDeliveryLog))
+	mux.HandleFunc("GET /templates", s.requireAuth(s.HandleListTemplates))
+	mux.HandleFunc("GET /templates/{name}", s.requireAuth(s.HandleGetTemplate))
+	mux.HandleFunc("PUT /templates/{name}", s.requireAuth(s.HandlePutTemplate))
+	mux.HandleFunc("DELETE /templates/{name}", s.requireAuth(s.HandleDeleteTemplate))
+	mux.HandleFunc("POST /templates/{name}/preview", s.requireAuth(s.HandlePreviewTemplate))
+	mux.HandleFunc("GET /stats", s.requireAuth(s.HandleStats))
+	mux.HandleFunc("GET /events", s.requireAuth(s.HandleEvents))
+	mux.HandleFunc("GET /webhooks", s.requireAuth(s.HandleListWebhooks))
+	mux.HandleFunc("POST /webhooks", s.requireAuth(s.HandlePostWebhook))
+	mux.HandleFunc("DELETE /webhooks/{id}", s.requireAuth(s.HandleDeleteWebhook))
+	mux.HandleFunc("GET /webhooks/{id}/deliveries", s.requireAuth(s.HandleListWebhookDeliveries))
+	mux.HandleFunc("GET /hooks", s.requireAuth(s.HandleListHooks))
+	mux.HandleFunc("GET /hooks/{name}", s.requireAuth(s.HandleGetHook))
+	mux.HandleFunc("PUT /hooks/{name}", s.requireAuth(s.HandlePutHook))
+	mux.HandleFunc("DELETE /hooks/{name}", s.requireAuth(s.HandleDeleteHook))
+	mux.HandleFunc("POST /hooks/{name}/test", s.requireAuth(s.HandleTestHook))
+	mux.HandleFunc("GET /gotify/apps", s.requireAuth(s.HandleListGotifyApps))
+	mux.HandleFunc("POST /gotify/apps", s.requireAuth(s.HandlePostGotifyApp))
+	mux.HandleFunc("DELETE /gotify/apps/{id}", s.requireAuth(s.HandleDeleteGotifyApp))
+	mux.HandleFunc("GET /topics", s.requireAuth(s.HandleListTopics))
+	mux.HandleFunc("GET /topics/{topic}/config", s.requireAuth(s.HandleGetTopic))
+	mux.HandleFunc("PUT /topics/{topic}/config", s.requireAuth(s.HandlePutTopic))
+	mux.HandleFunc("DELETE /topics/{topic}/config", s.requireAuth(s.HandleDeleteTopic))
 
 	// Apply middleware stack: CORS → logging → content-type validation
 	var handler http.Handler = mux
-	handler = contentTypeMiddleware(handler)
+	handler = contentTypeMiddleware(mux, handler)
 	handler = loggingMiddleware(handler)
 	handler = corsMiddleware(corsOrigin)(handler)
 
@@ -38,8 +87,9 @@ func corsMiddleware(origin string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
 
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
@@ -71,10 +121,31 @@ func (sw *statusWriter) WriteHeader(code int) {
 	sw.ResponseWriter.WriteHeader(code)
 }
 
-// contentTypeMiddleware validates Content-Type for POST and DELETE with body.
-func contentTypeMiddleware(next http.Handler) http.Handler {
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streaming handlers can flush.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// rawBodyPatterns are the routes of compatibility APIs whose clients send
+// bodies that are not (or not labelled as) JSON.
+var rawBodyPatterns = map[string]bool{
+	"POST /{$}":          true,
+	"POST /{topic}":      true,
+	"PUT /{topic}":       true,
+	"POST /message":      true,
+	"POST /hooks/{name}": true,
+}
+
+// contentTypeMiddleware validates Content-Type for POST, PUT, PATCH and DELETE
+// with body, except on the mux's rawBodyPatterns routes.
+func contentTypeMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if (r.Method == http.MethodPost || r.Method == http.MethodDelete) && r.ContentLength > 0 {
+		if (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete) && r.ContentLength > 0 {
+			if _, pattern := mux.Handler(r); rawBodyPatterns[pattern] {
+				next.ServeHTTP(w, r)
+				return
+			}
 			ct := r.Header.Get("Content-Type")
 			if !strings.HasPrefix(ct, "application/json") {
 				writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Type must be application/json, got %q", ct))
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+)
+
+// staticFiles holds the browser scripts served to web apps, the client
+// helpers (client.js) and the service worker (sw.js), each declaring its
+// VERSION, bumped on every change; and the hosted topic page (topic.html).
+//
+//go:embed static
+var staticFiles embed.FS
+
+var topicPage = template.Must(template.ParseFS(staticFiles, "static/topic.html"))
+
+// scriptHandler serves an embedded script. Browsers revalidate it on every
+// load against an ETag derived from its content, so an updated server binary
+// ships its new scripts right away.
+func scriptHandler(name string, headers map[string]string) http.HandlerFunc {
+	content, err := staticFiles.ReadFile("static/" + name)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etag)
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// HandleTopicPage serves the hosted subscribe page of a topic whose config
+// enables it, showing the topic's title, description and icon.
+func (s *Server) HandleTopicPage(w http.ResponseWriter, r *http.Request) {
+	t, err := GetTopicConfig(s.DB, r.PathValue("topic"))
+	if errors.Is(err, errTopicNotFound) || err == nil && !t.Page {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to get topic", http.StatusInternalServerError)
+		return
+	}
+	if t.Title == "" {
+		t.Title = t.Name
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := topicPage.Execute(w, t); err != nil {
+		log.Printf("error rendering page for topic %q: %v", t.Name, err)
+	}
+}
@@ -0,0 +1,174 @@
+// go-notify-server web client.
+//
+// Load it from the server with <script src="https://notify.example.com/client.js"></script>:
+// it talks to the server it was loaded from and exposes window.notifyClient.
+// Pushes are displayed by the service worker served at /sw.js (register it
+// from the same origin as your page, or importScripts() it from your own).
+(function () {
+  "use strict";
+
+  const VERSION = "1.0.0";
+  const script = document.currentScript;
+  const server = new URL(".", script ? script.src : location.href).href;
+  const topicsKey = "go-notify-server.topics";
+
+  let serviceWorkerURL = "/sw.js";
+  let serviceWorkerScope;
+
+  async function request(method, path, body) {
+    const resp = await fetch(new URL(path, server), {
+      method,
+      headers: body === undefined ? {} : { "Content-Type": "application/json" },
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    const data = resp.status === 204 ? null : await resp.json().catch(() => null);
+    if (!resp.ok) {
+      throw new Error((data && data.error) || `${method} ${path}: ${resp.status}`);
+    }
+    return data;
+  }
+
+  function base64URLToBytes(s) {
+    const b64 = s.replace(/-/g, "+").replace(/_/g, "/") + "=".repeat((4 - (s.length % 4)) % 4);
+    return Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+  }
+
+  function sameKey(a, b) {
+    if (!a || a.byteLength !== b.byteLength) return false;
+    const bytes = new Uint8Array(a);
+    return bytes.every((v, i) => v === b[i]);
+  }
+
+  // Topics this browser subscribed to through this client, by endpoint.
+  function storedTopics(endpoint) {
+    const all = JSON.parse(localStorage.getItem(topicsKey) || "{}");
+    return all[endpoint] || [];
+  }
+
+  function storeTopics(endpoint, topics) {
+    const all = JSON.parse(localStorage.getItem(topicsKey) || "{}");
+    if (topics.length) all[endpoint] = topics;
+    else delete all[endpoint];
+    localStorage.setItem(topicsKey, JSON.stringify(all));
+  }
+
+  function supported() {
+    return "serviceWorker" in navigator && "PushManager" in window && "Notification" in window;
+  }
+
+  // configure sets the service worker registered by subscribe() when the
+  // page has none yet. Defaults to /sw.js on the page's origin.
+  function configure(options) {
+    if (options.serviceWorker) serviceWorkerURL = options.serviceWorker;
+    if (options.scope) serviceWorkerScope = options.scope;
+  }
+
+  async function registration() {
+    const existing = await navigator.serviceWorker.getRegistration(serviceWorkerScope);
+    if (!existing) {
+      await navigator.serviceWorker.register(serviceWorkerURL, serviceWorkerScope ? { scope: serviceWorkerScope } : undefined);
+    }
+    return navigator.serviceWorker.ready;
+  }
+
+  // pushSubscription returns the browser's push subscription for this server,
+  // creating it (and asking for notification permission) if create is set.
+  async function pushSubscription(create) {
+    if (!supported()) throw new Error("push notifications are not supported by this browser");
+    const reg = await registration();
+    let sub = await reg.pushManager.getSubscription();
+    if (!create) return sub;
+
+    const { vapidPublicKey } = await request("GET", "vapid-public-key");
+    const key = base64URLToBytes(vapidPublicKey);
+    if (sub && !sameKey(sub.options.applicationServerKey, key)) {
+      // Subscribed with another server's key: it cannot receive our pushes.
+      await sub.unsubscribe();
+      sub = null;
+    }
+    if (!sub) {
+      if ((await Notification.requestPermission()) !== "granted") {
+        throw new Error("notification permission was not granted");
+      }
+      sub = await reg.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: key });
+    }
+    return sub;
+  }
+
+  // subscribe subscribes this browser to a topic ("" for broadcasts only).
+  // options.locale defaults to navigator.language. Returns the subscription ID.
+  async function subscribe(topic = "", options = {}) {
+    const sub = await pushSubscription(true);
+    const { id } = await request("POST", "subscriptions", {
+      topic,
+      locale: options.locale === undefined ? navigator.language : options.locale,
+      subscription: sub.toJSON(),
+    });
+    const topics = storedTopics(sub.endpoint);
+    if (!topics.includes(topic)) storeTopics(sub.endpoint, [...topics, topic]);
+    return id;
+  }
+
+  // unsubscribe removes this browser from a topic. Without a topic, it is
+  // removed from every topic and its push subscription is cancelled.
+  async function unsubscribe(topic) {
+    const sub = await pushSubscription(false);
+    if (!sub) return;
+    if (topic === undefined) {
+      await request("DELETE", "subscriptions", { endpoint: sub.endpoint });
+      storeTopics(sub.endpoint, []);
+      await sub.unsubscribe();
+      return;
+    }
+    await request("DELETE", "subscriptions", { endpoint: sub.endpoint, topic });
+    storeTopics(sub.endpoint, storedTopics(sub.endpoint).filter((t) => t !== topic));
+  }
+
+  // topics returns the topics this browser subscribed to through this client.
+  async function topics() {
+    if (!supported()) return [];
+    const sub = await pushSubscription(false);
+    return sub ? storedTopics(sub.endpoint) : [];
+  }
+
+  async function isSubscribed(topic = "") {
+    return (await topics()).includes(topic);
+  }
+
+  // toggle subscribes to or unsubscribes from a topic, flipping the current
+  // state unless on is given. Returns whether the browser is now subscribed.
+  async function toggle(topic = "", on) {
+    if (on === undefined) on = !(await isSubscribed(topic));
+    if (on) await subscribe(topic);
+    else await unsubscribe(topic);
+    return on;
+  }
+
+  // setPreferences updates the delivery preferences of this browser (see
+  // POST /subscriptions/preferences), e.g. { quiet_hours: { start: "22:00", end: "07:00" } }.
+  // The timezone defaults to the browser's.
+  async function setPreferences(prefs) {
+    const sub = await pushSubscription(false);
+    if (!sub) throw new Error("not subscribed");
+    const json = sub.toJSON();
+    await request("POST", "subscriptions/preferences", {
+      timezone: Intl.DateTimeFormat().resolvedOptions().timeZone,
+      ...prefs,
+      endpoint: json.endpoint,
+      auth: json.keys.auth,
+    });
+  }
+
+  window.notifyClient = {
+    VERSION,
+    server,
+    supported,
+    configure,
+    subscribe,
+    unsubscribe,
+    topics,
+    isSubscribed,
+    toggle,
+    setPreferences,
+  };
+})();
@@ -0,0 +1,101 @@
+// go-notify-server service worker.
+//
+// Displays pushes sent by the server, in both the Declarative Web Push
+// envelope ({"web_push": 8030, "notification": {...}}) and the legacy format,
+// closes retracted notifications, opens data.url (or navigate) on click, and
+// re-registers rotated subscriptions.
+//
+// Register it directly when your page is served from the notify server's
+// origin, or import it into your own service worker:
+//
+//   self.notifyServer = "https://notify.example.com/";
+//   importScripts("https://notify.example.com/sw.js");
+"use strict";
+
+(function () {
+  const VERSION = "1.0.0";
+  const server = self.notifyServer || new URL(".", self.location).href;
+
+  // Notification fields that differ from their showNotification() option name.
+  const renamed = { require_interaction: "requireInteraction" };
+
+  function options(n) {
+    const opts = {};
+    for (const key of ["body", "icon", "badge", "image", "tag", "lang", "dir", "timestamp", "renotify", "require_interaction", "silent", "vibrate"]) {
+      if (n[key] !== undefined) opts[renamed[key] || key] = n[key];
+    }
+    if (n.actions) {
+      opts.actions = n.actions.map(({ action, title, icon }) => ({ action, title, icon }));
+    }
+    // Keep the click targets next to the app's data for notificationclick.
+    const actions = {};
+    for (const a of n.actions || []) {
+      if (a.navigate) actions[a.action] = a.navigate;
+    }
+    opts.data = { ...(n.data || {}), _notify: { navigate: n.navigate, actions } };
+    return opts;
+  }
+
+  function setAppBadge(count) {
+    if (count === undefined || !("setAppBadge" in navigator)) return Promise.resolve();
+    return count > 0 ? navigator.setAppBadge(count) : navigator.clearAppBadge();
+  }
+
+  async function closeNotifications(tag) {
+    const list = await self.registration.getNotifications({ tag });
+    list.forEach((notification) => notification.close());
+  }
+
+  self.addEventListener("push", (event) => {
+    if (!event.data) return;
+    let payload;
+    try {
+      payload = event.data.json();
+    } catch {
+      payload = { title: event.data.text() };
+    }
+    const declarative = payload.web_push === 8030;
+    const n = declarative ? payload.notification || {} : payload;
+
+    if (n.data && n.data.retract) {
+      // An untagged retract would match every notification.
+      if (n.tag) event.waitUntil(closeNotifications(n.tag));
+      return;
+    }
+    event.waitUntil(Promise.all([
+      self.registration.showNotification(n.title || "", options(n)),
+      setAppBadge(declarative ? payload.app_badge : n.app_badge),
+    ]));
+  });
+
+  self.addEventListener("notificationclick", (event) => {
+    event.notification.close();
+    const data = event.notification.data || {};
+    const extra = data._notify || {};
+    const target = (event.action && extra.actions && extra.actions[event.action]) || data.url || extra.navigate;
+    if (!target) return;
+
+    const url = new URL(target, self.location.origin).href;
+    event.waitUntil((async () => {
+      const windows = await self.clients.matchAll({ type: "window", includeUncontrolled: true });
+      const open = windows.find((c) => c.url === url);
+      if (open) return open.focus();
+      return self.clients.openWindow(url);
+    })());
+  });
+
+  self.addEventListener("pushsubscriptionchange", (event) => {
+    const old = event.oldSubscription;
+    if (!old) return;
+    event.waitUntil((async () => {
+      const sub = event.newSubscription || await self.registration.pushManager.subscribe(old.options);
+      await fetch(new URL("subscriptions/rotate", server), {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ oldEndpoint: old.endpoint, subscription: sub.toJSON() }),
+      });
+    })());
+  });
+
+  self.notifyServiceWorker = { VERSION, server };
+})();
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Template is a stored notification whose fields are Go text/template
+// sources rendered with the request's vars.
+type Template struct {
+	Name      string         `json:"name"`
+	Title     string         `json:"title"`
+	Body      string         `json:"body,omitempty"`
+	Icon      string         `json:"icon,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+	CreatedAt string         `json:"created_at"`
+	UpdatedAt string         `json:"updated_at"`
+}
+
+var errTemplateNotFound = errors.New("template not found")
+
+var templateNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// UpsertTemplate creates or replaces a template. Returns whether it was created.
+func UpsertTemplate(db *sql.DB, t Template) (created bool, err error) {
+	data, err := json.Marshal(t.Data)
+	if err != nil {
+		return false, fmt.Errorf("marshal template data: %w", err)
+	}
+	if t.Data == nil {
+		data = []byte("{}")
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM templates WHERE name = ?)`, t.Name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("check template: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO templates (name, title, body, icon, data)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			title = excluded.title,
+			body = excluded.body,
+			icon = excluded.icon,
+			data = excluded.data,
+			updated_at = datetime('now')
+	`, t.Name, t.Title, t.Body, t.Icon, string(data))
+	if err != nil {
+		return false, fmt.Errorf("upsert template: %w", err)
+	}
+	return !exists, nil
+}
+
+// GetTemplate returns the named template, or errTemplateNotFound.
+func GetTemplate(db *sql.DB, name string) (Template, error) {
+	var t Template
+	var data string
+	err := db.QueryRow(`SELECT name, title, body, icon, data, created_at, updated_at FROM templates WHERE name = ?`, name).
+		Scan(&t.Name, &t.Title, &t.Body, &t.Icon, &data, &t.CreatedAt, &t.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Template{}, errTemplateNotFound
+	}
+	if err != nil {
+		return Template{}, fmt.Errorf("query template: %w", err)
+	}
+	if err := json.Unmarshal([]byte(data), &t.Data); err != nil {
+		return Template{}, fmt.Errorf("decode template data: %w", err)
+	}
+	return t, nil
+}
+
+// ListTemplates returns all templates ordered by name.
+func ListTemplates(db *sql.DB) ([]Template, error) {
+	rows, err := db.Query(`SELECT name, title, body, icon, data, created_at, updated_at FROM templates ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("query templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []Template
+	for rows.Next() {
+		var t Template
+		var data string
+		if err := rows.Scan(&t.Name, &t.Title, &t.Body, &t.Icon, &data, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan template: %w", err)
+		}
+		if err := json.Unmarshal([]byte(data), &t.Data); err != nil {
+			return nil, fmt.Errorf("decode template data: %w", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// DeleteTemplate removes a template by name.
+func DeleteTemplate(db *sql.DB, name string) error {
+	_, err := db.Exec(`DELETE FROM templates WHERE name = ?`, name)
+	return err
+}
+
+// renderString executes src as a text/template with vars. Missing vars are
+// an error rather than rendering as "<no value>".
+func renderString(name, src string, vars map[string]any) (string, error) {
+	if !strings.Contains(src, "{{") {
+		return src, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, vars); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return sb.String(), nil
+}
+
+// renderValue renders every string found in v (recursing into objects and
+// arrays) and leaves other JSON values untouched.
+func renderValue(name string, v any, vars map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return renderString(name, v, vars)
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			r, err := renderValue(name+"."+k, e, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			r, err := renderValue(fmt.Sprintf("%s[%d]", name, i), e, vars)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// Render returns the template's fields rendered with vars.
+func (t Template) Render(vars map[string]any) (Template, error) {
+	out := t
+	var err error
+	if out.Title, err = renderString("title", t.Title, vars); err != nil {
+		return Template{}, err
+	}
+	if out.Body, err = renderString("body", t.Body, vars); err != nil {
+		return Template{}, err
+	}
+	if out.Icon, err = renderString("icon", t.Icon, vars); err != nil {
+		return Template{}, err
+	}
+	if t.Data != nil {
+		data, err := renderValue("data", t.Data, vars)
+		if err != nil {
+			return Template{}, err
+		}
+		out.Data = data.(map[string]any)
+	}
+	return out, nil
+}
+
+// validate checks that the template is well-formed and all its fields parse.
+func (t Template) validate() error {
+	if t.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	for name, src := range map[string]string{"title": t.Title, "body": t.Body, "icon": t.Icon} {
+		if _, err := template.New(name).Parse(src); err != nil {
+			return err
+		}
+	}
+	var check func(name string, v any) error
+	check = func(name string, v any) error {
+		switch v := v.(type) {
+		case string:
+			_, err := template.New(name).Parse(v)
+			return err
+		case map[string]any:
+			for k, e := range v {
+				if err := check(name+"."+k, e); err != nil {
+					return err
+				}
+			}
+		case []any:
+			for i, e := range v {
+				if err := check(fmt.Sprintf("%s[%d]", name, i), e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return check("data", t.Data)
+}
+
+// applyTemplate renders req.Template (if any) with req.Vars into req.
+// Fields set explicitly on the request take precedence over the template,
+// and request data keys override template data keys.
+func applyTemplate(db *sql.DB, req *NotifyRequest) error {
+	if req.Template == "" {
+		return nil
+	}
+	t, err := GetTemplate(db, req.Template)
+	if err != nil {
+		return err
+	}
+	rendered, err := t.Render(req.Vars)
+	if err != nil {
+		return fmt.Errorf("render template %q: %w", req.Template, err)
+	}
+	if req.Title == "" {
+		req.Title = rendered.Title
+	}
+	if req.Body == "" {
+		req.Body = rendered.Body
+	}
+	if req.Icon == "" {
+		req.Icon = rendered.Icon
+	}
+	if len(rendered.Data) > 0 {
+		data := rendered.Data
+		maps.Copy(data, req.Data)
+		req.Data = data
+	}
+	return nil
+}
+
+// HandleListTemplates returns all notification templates (admin).
+func (s *Server) HandleListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := ListTemplates(s.DB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list templates")
+		return
+	}
+	if templates == nil {
+		templates = []Template{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"templates": templates})
+}
+
+// HandleGetTemplate returns a single template (admin).
+func (s *Server) HandleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	t, err := GetTemplate(s.DB, r.PathValue("name"))
+	if errors.Is(err, errTemplateNotFound) {
+		writeError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get template")
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// HandlePutTemplate creates or replaces a template (admin).
+func (s *Server) HandlePutTemplate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !templateNameRe.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "template name must be 1-64 letters, digits, '.', '_' or '-'")
+		return
+	}
+
+	var t Template
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	t.Name = name
+
+	if err := t.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created, err := UpsertTemplate(s.DB, t)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save template")
+		return
+	}
+
+	saved, err := GetTemplate(s.DB, name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get template")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, saved)
+}
+
+// HandleDeleteTemplate removes a template (admin).
+func (s *Server) HandleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteTemplate(s.DB, r.PathValue("name")); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete template")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePreviewTemplate renders a template with the given vars without
+// sending anything (admin).
+func (s *Server) HandlePreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Vars map[string]any `json:"vars"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+	}
+
+	t, err := GetTemplate(s.DB, r.PathValue("name"))
+	if errors.Is(err, errTemplateNotFound) {
+		writeError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get template")
+		return
+	}
+
+	rendered, err := t.Render(body.Vars)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"title": rendered.Title,
+		"body":  rendered.Body,
+		"icon":  rendered.Icon,
+		"data":  rendered.Data,
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TopicConfig holds per-topic delivery settings, the metadata shown on the
+// topic's subscribe page and the secrets of its GitHub and GitLab webhooks.
+// Topics do not need a config to be used; unconfigured topics get the
+// defaults.
+type TopicConfig struct {
+	Name          string   `json:"name"`
+	FrequencyCap  string   `json:"frequency_cap,omitempty"`
+	BatchWindow   string   `json:"batch_window,omitempty"`
+	BatchTemplate string   `json:"batch_template,omitempty"`
+	Title         string   `json:"title,omitempty"`
+	Description   string   `json:"description,omitempty"`
+	Icon          string   `json:"icon,omitempty"`
+	Page          bool     `json:"page,omitempty"`
+	GitHubSecret  string   `json:"github_secret,omitempty"`
+	GitLabToken   string   `json:"gitlab_token,omitempty"`
+	RepoEvents    []string `json:"repo_events,omitempty"`
+	CreatedAt     string   `json:"created_at"`
+	UpdatedAt     string   `json:"updated_at"`
+}
+
+// topicColumns lists the columns scanned by scanTopicConfig.
+const topicColumns = `name, frequency_cap, batch_window, batch_template, title, description, icon, page, github_secret, gitlab_token, repo_events, created_at, updated_at`
+
+func scanTopicConfig(row interface{ Scan(...any) error }) (TopicConfig, error) {
+	var t TopicConfig
+	var repoEvents string
+	err := row.Scan(&t.Name, &t.FrequencyCap, &t.BatchWindow, &t.BatchTemplate, &t.Title, &t.Description, &t.Icon, &t.Page,
+		&t.GitHubSecret, &t.GitLabToken, &repoEvents, &t.CreatedAt, &t.UpdatedAt)
+	if repoEvents != "" {
+		t.RepoEvents = strings.Split(repoEvents, ",")
+	}
+	return t, err
+}
+
+var errTopicNotFound = errors.New("topic not found")
+
+// FrequencyCap limits how many notifications a subscription receives
+// within a sliding window. The zero value means no cap.
+type FrequencyCap struct {
+	Max    int
+	Window time.Duration
+}
+
+// parseFrequencyCap parses "N/duration" (e.g. "5/1h", "50/1d"). An empty
+// string is no cap.
+func parseFrequencyCap(s string) (FrequencyCap, error) {
+	if s == "" {
+		return FrequencyCap{}, nil
+	}
+	n, window, ok := strings.Cut(s, "/")
+	count, err := strconv.Atoi(n)
+	if !ok || err != nil || count < 1 {
+		return FrequencyCap{}, fmt.Errorf("invalid frequency cap %q (use e.g. 5/1h)", s)
+	}
+	dur, err := parseDuration(window)
+	if err != nil || dur <= 0 {
+		return FrequencyCap{}, fmt.Errorf("invalid frequency cap %q (use e.g. 5/1h)", s)
+	}
+	return FrequencyCap{Max: count, Window: dur}, nil
+}
+
+// UpsertTopicConfig creates or replaces a topic config. Returns whether it was created.
+func UpsertTopicConfig(db *sql.DB, t TopicConfig) (created bool, err error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM topics WHERE name = ?)`, t.Name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("check topic: %w", err)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO topics (name, frequency_cap, batch_window, batch_template, title, description, icon, page, github_secret, gitlab_token, repo_events)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			frequency_cap = excluded.frequency_cap,
+			batch_window = excluded.batch_window,
+			batch_template = excluded.batch_template,
+			title = excluded.title,
+			description = excluded.description,
+			icon = excluded.icon,
+			page = excluded.page,
+			github_secret = excluded.github_secret,
+			gitlab_token = excluded.gitlab_token,
+			repo_events = excluded.repo_events,
+			updated_at = datetime('now')
+	`, t.Name, t.FrequencyCap, t.BatchWindow, t.BatchTemplate, t.Title, t.Description, t.Icon, t.Page,
+		t.GitHubSecret, t.GitLabToken, strings.Join(t.RepoEvents, ","))
+	if err != nil {
+		return false, fmt.Errorf("upsert topic: %w", err)
+	}
+	return !exists, nil
+}
+
+// GetTopicConfig returns the config of a topic, or errTopicNotFound.
+func GetTopicConfig(db *sql.DB, name string) (TopicConfig, error) {
+	t, err := scanTopicConfig(db.QueryRow(`SELECT `+topicColumns+` FROM topics WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return TopicConfig{}, errTopicNotFound
+	}
+	if err != nil {
+		return TopicConfig{}, fmt.Errorf("query topic: %w", err)
+	}
+	return t, nil
+}
+
+// ListTopicConfigs returns all topic configs ordered by name.
+func ListTopicConfigs(db *sql.DB) ([]TopicConfig, error) {
+	rows, err := db.Query(`SELECT ` + topicColumns + ` FROM topics ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("query topics: %w", err)
+	}
+	defer rows.Close()
+
+	var topics []TopicConfig
+	for rows.Next() {
+		t, err := scanTopicConfig(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan topic: %w", err)
+		}
+		topics = append(topics, t)
+	}
+	return topics, rows.Err()
+}
+
+// DeleteTopicConfig removes a topic config (subscriptions are untouched).
+func DeleteTopicConfig(db *sql.DB, name string) error {
+	_, err := db.Exec(`DELETE FROM topics WHERE name = ?`, name)
+	return err
+}
+
+// CountDeliveries returns the number of successful deliveries to a
+// subscription since the given time.
+func CountDeliveries(db *sql.DB, subscriptionID string, since time.Time) (int, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM delivery_log
+		WHERE subscription_id = ? AND sent_at >= ? AND status_code BETWEEN 200 AND 299
+	`, subscriptionID, since.UTC().Format("2006-01-02 15:04:05")).Scan(&n)
+	return n, err
+}
+
+// CountEndpointDeliveries returns the number of successful deliveries to a
+// browser endpoint, across all of its topics, since the given time.
+func CountEndpointDeliveries(db *sql.DB, endpoint string, since time.Time) (int, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM delivery_log d
+		JOIN subscriptions s ON s.id = d.subscription_id
+		WHERE s.endpoint = ? AND d.sent_at >= ? AND d.status_code BETWEEN 200 AND 299
+	`, endpoint, since.UTC().Format("2006-01-02 15:04:05")).Scan(&n)
+	return n, err
+}
+
+// capReservations counts the deliveries let through by frequency caps that
+// are not in the delivery log yet, per subscription and per endpoint, so that
+// concurrent fan-outs count each other's sends. The zero value is ready to
+// use.
+type capReservations struct {
+	mu        sync.Mutex
+	subs      map[string]int
+	endpoints map[string]int
+}
+
+// release gives back the reservation of a delivery once it is logged.
+func (c *capReservations) release(sub Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs[sub.ID]--; c.subs[sub.ID] <= 0 {
+		delete(c.subs, sub.ID)
+	}
+	if c.endpoints[sub.Endpoint]--; c.endpoints[sub.Endpoint] <= 0 {
+		delete(c.endpoints, sub.Endpoint)
+	}
+}
+
+// applyFrequencyCaps splits subs into those still under their topic's cap
+// and the server-wide per-device cap, and the number that were capped.
+// Deliveries are counted from the delivery log plus those reserved by
+// fan-outs in progress. With reserve, the allowed deliveries are reserved
+// too, until deliver logs them; checks run one at a time, so concurrent
+// fan-outs cannot all pass on the same count.
+func (s *Server) applyFrequencyCaps(subs []Subscription, reserve bool) (allowed []Subscription, capped int) {
+	s.caps.mu.Lock()
+	defer s.caps.mu.Unlock()
+
+	now := time.Now()
+	topicCaps := make(map[string]FrequencyCap)
+	endpointCounts := make(map[string]int)
+	// Deliveries allowed earlier in this fan-out.
+	ownEndpoints := make(map[string]int)
+
+	for _, sub := range subs {
+		topicCap, ok := topicCaps[sub.Topic]
+		if !ok {
+			if t, err := GetTopicConfig(s.DB, sub.Topic); err == nil {
+				topicCap, _ = parseFrequencyCap(t.FrequencyCap)
+			} else if !errors.Is(err, errTopicNotFound) {
+				log.Printf("error loading topic %q: %v", sub.Topic, err)
+			}
+			topicCaps[sub.Topic] = topicCap
+		}
+
+		if topicCap.Max > 0 {
+			n, err := CountDeliveries(s.DB, sub.ID, now.Add(-topicCap.Window))
+			if err != nil {
+				log.Printf("error counting deliveries for %s: %v", sub.ID, err)
+			} else if n+s.caps.subs[sub.ID] >= topicCap.Max {
+				capped++
+				continue
+			}
+		}
+
+		if s.FrequencyCap.Max > 0 {
+			n, ok := endpointCounts[sub.Endpoint]
+			if !ok {
+				var err error
+				n, err = CountEndpointDeliveries(s.DB, sub.Endpoint, now.Add(-s.FrequencyCap.Window))
+				if err != nil {
+					log.Printf("error counting deliveries for %s: %v", sub.ID, err)
+				}
+				endpointCounts[sub.Endpoint] = n
+			}
+			if n+s.caps.endpoints[sub.Endpoint]+ownEndpoints[sub.Endpoint] >= s.FrequencyCap.Max {
+				capped++
+				continue
+			}
+		}
+
+		ownEndpoints[sub.Endpoint]++
+		allowed = append(allowed, sub)
+	}
+
+	if reserve {
+		if s.caps.subs == nil {
+			s.caps.subs = make(map[string]int)
+			s.caps.endpoints = make(map[string]int)
+		}
+		for _, sub := range allowed {
+			s.caps.subs[sub.ID]++
+		}
+		for endpoint, n := range ownEndpoints {
+			s.caps.endpoints[endpoint] += n
+		}
+	}
+	return allowed, capped
+}
+
+// withoutSecrets returns t with its webhook secrets blanked, as topic
+// configs are returned by the admin API: secrets are write-only.
+func (t TopicConfig) withoutSecrets() TopicConfig {
+	t.GitHubSecret = ""
+	t.GitLabToken = ""
+	return t
+}
+
+// HandleListTopics returns all topic configs, without their webhook secrets
+// (admin).
+func (s *Server) HandleListTopics(w http.ResponseWriter, r *http.Request) {
+	topics, err := ListTopicConfigs(s.DB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list topics")
+		return
+	}
+	for i := range topics {
+		topics[i] = topics[i].withoutSecrets()
+	}
+	if topics == nil {
+		topics = []TopicConfig{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"topics": topics})
+}
+
+// HandleGetTopic returns a single topic config, without its webhook secrets
+// (admin).
+func (s *Server) HandleGetTopic(w http.ResponseWriter, r *http.Request) {
+	t, err := GetTopicConfig(s.DB, r.PathValue("topic"))
+	if errors.Is(err, errTopicNotFound) {
+		writeError(w, http.StatusNotFound, "topic not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get topic")
+		return
+	}
+	writeJSON(w, http.StatusOK, t.withoutSecrets())
+}
+
+// HandlePutTopic creates or replaces a topic config (admin).
+func (s *Server) HandlePutTopic(w http.ResponseWriter, r *http.Request) {
+	// The webhook settings are decoded apart to tell omitted from empty.
+	var body struct {
+		TopicConfig
+		GitHubSecret *string   `json:"github_secret"`
+		GitLabToken  *string   `json:"gitlab_token"`
+		RepoEvents   *[]string `json:"repo_events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	t := body.TopicConfig
+	t.Name = r.PathValue("topic")
+	if reservedTopics[t.Name] {
+		writeError(w, http.StatusBadRequest, reservedTopicMsg)
+		return
+	}
+
+	// Omitted webhook settings are kept: they are not returned by GET, so a
+	// read-modify-write of the other settings must not disable the receivers.
+	existing, err := GetTopicConfig(s.DB, t.Name)
+	if err != nil && !errors.Is(err, errTopicNotFound) {
+		writeError(w, http.StatusInternalServerError, "failed to get topic")
+		return
+	}
+	t.GitHubSecret, t.GitLabToken, t.RepoEvents = existing.GitHubSecret, existing.GitLabToken, existing.RepoEvents
+	if body.GitHubSecret != nil {
+		t.GitHubSecret = *body.GitHubSecret
+	}
+	if body.GitLabToken != nil {
+		t.GitLabToken = *body.GitLabToken
+	}
+	if body.RepoEvents != nil {
+		t.RepoEvents = *body.RepoEvents
+	}
+
+	if _, err := parseFrequencyCap(t.FrequencyCap); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if t.BatchWindow != "" {
+		if _, err := parseDuration(t.BatchWindow); err != nil {
+			writeError(w, http.StatusBadRequest, "batch_window: "+err.Error())
+			return
+		}
+	}
+	if t.BatchTemplate != "" {
+		if t.BatchWindow == "" {
+			writeError(w, http.StatusBadRequest, "batch_template requires batch_window")
+			return
+		}
+		if _, err := GetTemplate(s.DB, t.BatchTemplate); errors.Is(err, errTemplateNotFound) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("template %q not found", t.BatchTemplate))
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to get template")
+			return
+		}
+	}
+
+	for _, e := range t.RepoEvents {
+		if !slices.Contains(repoEventTypes, e) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown repo event %q (use %s)", e, strings.Join(repoEventTypes, ", ")))
+			return
+		}
+	}
+
+	created, err := UpsertTopicConfig(s.DB, t)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save topic")
+		return
+	}
+
+	saved, err := GetTopicConfig(s.DB, t.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get topic")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, saved.withoutSecrets())
+}
+
+// HandleDeleteTopic removes a topic config (admin).
+func (s *Server) HandleDeleteTopic(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteTopicConfig(s.DB, r.PathValue("topic")); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete topic")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types delivered to webhooks.
+const (
+	eventSubscriptionCreated   = "subscription.created"
+	eventSubscriptionRemoved   = "subscription.removed"
+	eventDeliveryFailed        = "delivery.failed"
+	eventNotificationCompleted = "notification.completed"
+)
+
+var eventTypes = []string{eventSubscriptionCreated, eventSubscriptionRemoved, eventDeliveryFailed, eventNotificationCompleted}
+
+// Event is a server event, as posted to webhooks.
+type Event struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	CreatedAt string `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// SubscriptionEvent is the data of subscription.* events.
+type SubscriptionEvent struct {
+	ID       string `json:"id"`
+	Topic    string `json:"topic"`
+	Endpoint string `json:"endpoint"`
+	Reason   string `json:"reason,omitempty"` // subscription.removed: unsubscribed, admin or stale
+}
+
+// DeliveryEvent is the data of delivery.* events.
+type DeliveryEvent struct {
+	NotificationID string `json:"notification_id,omitempty"`
+	Topic          string `json:"topic"`
+	DeliveryResult
+}
+
+// NotificationCompletedEvent is the data of notification.completed events.
+type NotificationCompletedEvent struct {
+	Topic string `json:"topic"`
+	NotifyResult
+}
+
+// Webhook is an admin-registered URL receiving server events.
+type Webhook struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// WebhookDelivery is one attempt to post an event to a webhook.
+type WebhookDelivery struct {
+	ID         int64  `json:"id"`
+	EventID    string `json:"event_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+var errWebhookNotFound = errors.New("webhook not found")
+
+// webhookRetryDelays are the waits before each retry of a failed webhook
+// delivery.
+var webhookRetryDelays = []time.Duration{time.Second, 4 * time.Second, 16 * time.Second}
+
+// CreateWebhook stores a new webhook.
+func CreateWebhook(db *sql.DB, wh Webhook) (Webhook, error) {
+	wh.ID = randomID()
+	_, err := db.Exec(`INSERT INTO webhooks (id, url, events, secret) VALUES (?, ?, ?, ?)`,
+		wh.ID, wh.URL, strings.Join(wh.Events, ","), wh.Secret)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("insert webhook: %w", err)
+	}
+	return GetWebhook(db, wh.ID)
+}
+
+// GetWebhook returns a webhook (including its secret), or errWebhookNotFound.
+func GetWebhook(db *sql.DB, id string) (Webhook, error) {
+	var wh Webhook
+	var events string
+	err := db.QueryRow(`SELECT id, url, events, secret, created_at FROM webhooks WHERE id = ?`, id).
+		Scan(&wh.ID, &wh.URL, &events, &wh.Secret, &wh.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Webhook{}, errWebhookNotFound
+	}
+	if err != nil {
+		return Webhook{}, fmt.Errorf("query webhook: %w", err)
+	}
+	wh.Events = strings.Split(events, ",")
+	return wh, nil
+}
+
+// ListWebhooks returns all webhooks (including their secrets).
+func ListWebhooks(db *sql.DB) ([]Webhook, error) {
+	rows, err := db.Query(`SELECT id, url, events, secret, created_at FROM webhooks ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var wh Webhook
+		var events string
+		if err := rows.Scan(&wh.ID, &wh.URL, &events, &wh.Secret, &wh.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook: %w", err)
+		}
+		wh.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook and its delivery log.
+func DeleteWebhook(db *sql.DB, id string) error {
+	if _, err := db.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	return err
+}
+
+// LogWebhookDelivery records a delivery attempt in a webhook's delivery log.
+func LogWebhookDelivery(db *sql.DB, webhookID string, ev Event, attempt, statusCode int, errMsg string) error {
+	_, err := db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event_id, event, attempt, status_code, error) VALUES (?, ?, ?, ?, ?, ?)`,
+		webhookID, ev.ID, ev.Type, attempt, statusCode, errMsg)
+	return err
+}
+
+// ListWebhookDeliveries returns the most recent delivery attempts of a webhook.
+func ListWebhookDeliveries(db *sql.DB, webhookID string, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`
+		SELECT id, event_id, event, attempt, status_code, error, created_at FROM webhook_deliveries
+		WHERE webhook_id = ? ORDER BY id DESC LIMIT ?
+	`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.EventID, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// PurgeWebhookDeliveries deletes webhook delivery log entries older than the given duration.
+func PurgeWebhookDeliveries(db *sql.DB, olderThan time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-olderThan).Format("2006-01-02 15:04:05")
+	result, err := db.Exec(`DELETE FROM webhook_deliveries WHERE created_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// signWebhookPayload returns the X-Webhook-Signature header value for body.
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookCache holds the registered webhooks, so that publishing an event
+// does not query them again. POST and DELETE /webhooks invalidate it. The
+// zero value is ready to use.
+type webhookCache struct {
+	mu       sync.Mutex
+	webhooks []Webhook
+	loaded   bool
+}
+
+// list returns the registered webhooks, loading them on first use.
+func (c *webhookCache) list(db *sql.DB) ([]Webhook, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loaded {
+		webhooks, err := ListWebhooks(db)
+		if err != nil {
+			return nil, err
+		}
+		c.webhooks, c.loaded = webhooks, true
+	}
+	return c.webhooks, nil
+}
+
+// invalidate makes the next list reload the webhooks.
+func (c *webhookCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.webhooks, c.loaded = nil, false
+}
+
+// publishEvent streams an event on GET /events and delivers it to the
+// webhooks subscribed to its type. Deliveries run in the background and are
+// retried with backoff.
+func (s *Server) publishEvent(typ string, data any) {
+	ev := s.streamEvent(typ, data)
+
+	webhooks, err := s.webhooks.list(s.DB)
+	if err != nil {
+		log.Printf("error loading webhooks: %v", err)
+		return
+	}
+	var body []byte
+	for _, wh := range webhooks {
+		if !slices.Contains(wh.Events, typ) {
+			continue
+		}
+		if body == nil {
+			if body, err = json.Marshal(ev); err != nil {
+				log.Printf("error encoding %s event: %v", typ, err)
+				return
+			}
+		}
+		s.WG.Add(1)
+		go func(wh Webhook) {
+			defer s.WG.Done()
+			s.deliverWebhook(wh, ev, body)
+		}(wh)
+	}
+}
+
+// deliverWebhook posts an event to a webhook, retrying after each of
+// webhookRetryDelays until it gets a 2xx response. Every attempt is logged.
+func (s *Server) deliverWebhook(wh Webhook, ev Event, body []byte) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for attempt := 1; ; attempt++ {
+		statusCode, errMsg := postWebhook(client, wh, ev, body)
+		if err := LogWebhookDelivery(s.DB, wh.ID, ev, attempt, statusCode, errMsg); err != nil {
+			log.Printf("error logging webhook delivery for %s: %v", wh.ID, err)
+		}
+		if statusCode >= 200 && statusCode < 300 {
+			return
+		}
+		if attempt > len(webhookRetryDelays) {
+			log.Printf("webhook %s: giving up on %s event %s after %d attempts", wh.ID, ev.Type, ev.ID, attempt)
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt-1])
+	}
+}
+
+func postWebhook(client *http.Client, wh Webhook, ev Event, body []byte) (statusCode int, errMsg string) {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-notify-server")
+	req.Header.Set("X-Webhook-Event", ev.Type)
+	req.Header.Set("X-Webhook-ID", ev.ID)
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(wh.Secret, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+	return resp.StatusCode, ""
+}
+
+// HandleListWebhooks returns all webhooks, without their secrets (admin).
+func (s *Server) HandleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := ListWebhooks(s.DB)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	if webhooks == nil {
+		webhooks = []Webhook{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"webhooks": webhooks})
+}
+
+// HandlePostWebhook registers a webhook (admin). The response includes the
+// signing secret, generated if not provided.
+func (s *Server) HandlePostWebhook(w http.ResponseWriter, r *http.Request) {
+	var wh Webhook
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, "url must be an absolute http(s) URL")
+		return
+	}
+	if len(wh.Events) == 0 {
+		wh.Events = eventTypes
+	}
+	for _, e := range wh.Events {
+		if !slices.Contains(eventTypes, e) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown event %q (use %s)", e, strings.Join(eventTypes, ", ")))
+			return
+		}
+	}
+	if wh.Secret == "" {
+		wh.Secret = randomID()
+	}
+
+	created, err := CreateWebhook(s.DB, wh)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save webhook")
+		return
+	}
+	s.webhooks.invalidate()
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// HandleDeleteWebhook removes a webhook (admin).
+func (s *Server) HandleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteWebhook(s.DB, r.PathValue("id")); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	s.webhooks.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListWebhookDeliveries returns the last 100 delivery attempts of a webhook (admin).
+func (s *Server) HandleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := GetWebhook(s.DB, id); errors.Is(err, errWebhookNotFound) {
+		writeError(w, http.StatusNotFound, "webhook not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get webhook")
+		return
+	}
+
+	deliveries, err := ListWebhookDeliveries(s.DB, id, 100)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list webhook deliveries")
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deliveries": deliveries})
+}